@@ -0,0 +1,116 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package github is a minimal client around the subset of the GitHub API
+// that the review bot needs: listing reviews left on a pull request and the
+// files it touches.
+package github
+
+import (
+	"context"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/gravitational/trace"
+)
+
+// Review is a GitHub review.
+type Review struct {
+	// Author is the GitHub login of the reviewer.
+	Author string
+	// State is the state of the review, for example "APPROVED" or
+	// "CHANGES_REQUESTED".
+	State string
+}
+
+// Client is a wrapper around the GitHub API client.
+type Client struct {
+	client *github.Client
+}
+
+// New returns a new Client.
+func New(ctx context.Context, client *github.Client) *Client {
+	return &Client{
+		client: client,
+	}
+}
+
+// ListReviews returns all reviews for the given pull request.
+func (c *Client) ListReviews(ctx context.Context, organization string, repository string, number int) ([]Review, error) {
+	var reviews []Review
+
+	pages, _, err := c.client.PullRequests.ListReviews(ctx, organization, repository, number, &github.ListOptions{
+		PerPage: 100,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	for _, review := range pages {
+		reviews = append(reviews, Review{
+			Author: review.GetUser().GetLogin(),
+			State:  review.GetState(),
+		})
+	}
+
+	return reviews, nil
+}
+
+// ListFiles returns the paths of all files changed by the given pull
+// request.
+func (c *Client) ListFiles(ctx context.Context, organization string, repository string, number int) ([]string, error) {
+	var files []string
+
+	pages, _, err := c.client.PullRequests.ListFiles(ctx, organization, repository, number, &github.ListOptions{
+		PerPage: 100,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	for _, file := range pages {
+		files = append(files, file.GetFilename())
+	}
+
+	return files, nil
+}
+
+// GetContents returns the raw contents of path at ref.
+func (c *Client) GetContents(ctx context.Context, organization string, repository string, path string, ref string) ([]byte, error) {
+	contents, _, _, err := c.client.Repositories.GetContents(ctx, organization, repository, path, &github.RepositoryContentGetOptions{
+		Ref: ref,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	data, err := contents.GetContent()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return []byte(data), nil
+}
+
+// CreateReviewComment posts an inline comment on the given line of path in
+// the pull request.
+func (c *Client) CreateReviewComment(ctx context.Context, organization string, repository string, number int, path string, line int, body string) error {
+	_, _, err := c.client.PullRequests.CreateComment(ctx, organization, repository, number, &github.PullRequestComment{
+		Body: github.String(body),
+		Path: github.String(path),
+		Line: github.Int(line),
+	})
+	return trace.Wrap(err)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2024 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package middleware provides a small interceptor chain (modeled after
+// go-grpc-middleware's recovery interceptors) that the review bot's
+// top-level event handlers are wrapped in.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Handler processes a single bot event, for example an incoming PR review
+// webhook that is about to be passed to Assignments.CheckInternal or
+// CheckExternal.
+type Handler func(ctx context.Context) error
+
+// Middleware wraps a Handler with additional behavior.
+type Middleware func(next Handler) Handler
+
+// Chain composes middlewares into a single Middleware, running them in the
+// order given -- the first middleware is outermost (it sees the final
+// error/recovery outcome of everything after it), and the last middleware
+// is innermost (closest to the wrapped Handler). For example,
+// Chain(Metrics(...), Recovery()) lets Metrics observe the error Recovery
+// converts a panic into.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Recovery returns a Middleware that recovers from a panic in the wrapped
+// Handler, logs the stack trace, and converts the panic into a returned
+// error so a single bad event can't take down the process.
+func Recovery() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("recovered from panic: %v\n%s", r, debug.Stack())
+					err = fmt.Errorf("panic handling event: %v", r)
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+// HandlerErrors is the default counter incremented by Metrics when a caller
+// does not supply its own.
+var HandlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "review_bot",
+	Name:      "handler_errors_total",
+	Help:      "Total number of bot event handlers that returned an error, including recovered panics.",
+}, []string{"handler"})
+
+// Metrics returns a Middleware that increments counter, labeled with name,
+// whenever the wrapped Handler returns an error.
+func Metrics(name string, counter *prometheus.CounterVec) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context) error {
+			err := next(ctx)
+			if err != nil {
+				counter.WithLabelValues(name).Inc()
+			}
+			return err
+		}
+	}
+}
+
+// Logging returns a Middleware that logs the outcome of the wrapped
+// Handler.
+func Logging(name string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context) error {
+			err := next(ctx)
+			if err != nil {
+				log.Printf("%v: failed: %v", name, err)
+			} else {
+				log.Printf("%v: succeeded", name)
+			}
+			return err
+		}
+	}
+}
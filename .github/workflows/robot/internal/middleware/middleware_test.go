@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func counterValue(t *testing.T, counter *prometheus.CounterVec, labels ...string) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	require.NoError(t, counter.WithLabelValues(labels...).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+// TestRecoveryConvertsPanicToError checks that a panicking handler doesn't
+// crash the caller, but instead returns an error.
+func TestRecoveryConvertsPanicToError(t *testing.T) {
+	handler := Recovery()(func(ctx context.Context) error {
+		panic("boom")
+	})
+
+	err := handler(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "boom")
+}
+
+// TestChainRunsMiddlewareInOrderAndSurvivesPanic checks that Chain composes
+// Recovery and Metrics so the server keeps running after a panic, the error
+// is surfaced to the caller, and the counter is incremented.
+func TestChainRunsMiddlewareInOrderAndSurvivesPanic(t *testing.T) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_handler_errors_total",
+	}, []string{"handler"})
+
+	chain := Chain(Metrics("test", counter), Recovery())
+	handler := chain(func(ctx context.Context) error {
+		panic("kaboom")
+	})
+
+	// The first call panics internally, but the middleware must recover and
+	// return an error rather than crash the test process.
+	err := handler(context.Background())
+	require.Error(t, err)
+	require.Equal(t, float64(1), counterValue(t, counter, "test"))
+
+	// The server (and this same chain) must continue to work afterwards.
+	handler2 := chain(func(ctx context.Context) error {
+		return nil
+	})
+	require.NoError(t, handler2(context.Background()))
+	require.Equal(t, float64(1), counterValue(t, counter, "test"))
+}
+
+// TestMetricsOnlyCountsErrors checks that a successful Handler does not
+// increment the error counter.
+func TestMetricsOnlyCountsErrors(t *testing.T) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_handler_errors_total_success",
+	}, []string{"handler"})
+
+	handler := Metrics("ok", counter)(func(ctx context.Context) error {
+		return nil
+	})
+	require.NoError(t, handler(context.Background()))
+	require.Equal(t, float64(0), counterValue(t, counter, "ok"))
+}
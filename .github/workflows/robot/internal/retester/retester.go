@@ -0,0 +1,283 @@
+/*
+Copyright 2024 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package retester automatically retries pull request checks that fail with
+// a known-flaky signature, once a PR has already satisfied its review
+// requirements.
+package retester
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/.github/workflows/robot/internal/github"
+	"github.com/gravitational/teleport/.github/workflows/robot/internal/review"
+	"github.com/gravitational/trace"
+)
+
+// Config is the configuration for the retester.
+type Config struct {
+	// CachePath is the path to the JSON file the per-PR retry state is
+	// persisted to between runs.
+	CachePath string
+	// MaxRetries is the hard cap on the number of retries for a single PR.
+	MaxRetries int
+	// MinInterval is the base interval enforced between retries for a
+	// single PR. It is doubled after each retry (exponential backoff).
+	MinInterval time.Duration
+	// FlakyPatterns are regexes matched against a failed check run's name.
+	// A failure is only retried if it matches one of these.
+	FlakyPatterns []string
+	// EnableOnOrgs and EnableOnRepos allow-list the organizations and
+	// repositories the retester is actually allowed to retry checks on.
+	// Outside the allow-list, matches are logged but not acted on.
+	EnableOnOrgs  []string
+	EnableOnRepos []string
+}
+
+// CheckAndSetDefaults checks and sets default values.
+func (c *Config) CheckAndSetDefaults() error {
+	if c.CachePath == "" {
+		c.CachePath = "retester-cache.json"
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = 3
+	}
+	if c.MinInterval <= 0 {
+		c.MinInterval = 5 * time.Minute
+	}
+	if len(c.FlakyPatterns) == 0 {
+		return trace.BadParameter("at least one flaky pattern is required")
+	}
+	return nil
+}
+
+// PullRequest identifies the pull request being considered for a retry.
+type PullRequest struct {
+	Organization string
+	Repository   string
+	Number       int
+}
+
+// key is the cache key used to persist retry state for this PR.
+func (p PullRequest) key() string {
+	return fmt.Sprintf("%v/%v#%v", p.Organization, p.Repository, p.Number)
+}
+
+// CheckRun is a single GitHub check run.
+type CheckRun struct {
+	ID         int64
+	Name       string
+	Conclusion string
+}
+
+// ChecksClient is the subset of the GitHub checks API the retester needs.
+type ChecksClient interface {
+	// ListCheckRuns returns the most recent check runs for pr.
+	ListCheckRuns(ctx context.Context, pr PullRequest) ([]CheckRun, error)
+	// RerunCheckRun re-dispatches the given, already-completed check run.
+	RerunCheckRun(ctx context.Context, pr PullRequest, checkRunID int64) error
+}
+
+// entry is the persisted retry state for a single PR.
+type entry struct {
+	Count     int       `json:"count"`
+	LastRetry time.Time `json:"lastRetry"`
+}
+
+// cacheFile is the on-disk representation of the retry cache.
+type cacheFile struct {
+	Entries map[string]*entry `json:"entries"`
+}
+
+// Retester decides whether a PR's failing checks should be retried.
+type Retester struct {
+	c        Config
+	patterns []*regexp.Regexp
+
+	mu    sync.Mutex
+	cache *cacheFile
+}
+
+// New returns a new Retester, loading any existing cache from disk.
+func New(c Config) (*Retester, error) {
+	if err := c.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(c.FlakyPatterns))
+	for _, pattern := range c.FlakyPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		patterns = append(patterns, re)
+	}
+
+	r := &Retester{
+		c:        c,
+		patterns: patterns,
+	}
+	if err := r.load(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return r, nil
+}
+
+// load reads the retry cache from disk, tolerating a missing file.
+func (r *Retester) load() error {
+	data, err := os.ReadFile(r.c.CachePath)
+	if os.IsNotExist(err) {
+		r.cache = &cacheFile{Entries: map[string]*entry{}}
+		return nil
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var cache cacheFile
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return trace.Wrap(err)
+	}
+	if cache.Entries == nil {
+		cache.Entries = map[string]*entry{}
+	}
+	r.cache = &cache
+	return nil
+}
+
+// save persists the retry cache to disk.
+func (r *Retester) save() error {
+	data, err := json.MarshalIndent(r.cache, "", "  ")
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := os.WriteFile(r.c.CachePath, data, 0o600); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// enabled reports whether the retester is allowed to act (and not just log)
+// for the given organization/repository.
+func (r *Retester) enabled(organization string, repository string) bool {
+	for _, org := range r.c.EnableOnOrgs {
+		if org == organization {
+			return true
+		}
+	}
+	for _, repo := range r.c.EnableOnRepos {
+		if repo == repository {
+			return true
+		}
+	}
+	return false
+}
+
+// isFlaky reports whether a check run's name matches a known-flaky pattern.
+func (r *Retester) isFlaky(name string) bool {
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retest inspects pr's check runs and, if any failures match a known-flaky
+// signature, requests a rerun -- subject to MaxRetries, MinInterval, the
+// enable allow-list, and the PR still satisfying its review requirements
+// (an approval withdrawn via a later "changes requested" review means the
+// PR is skipped until a human looks at it again). It returns true if a
+// retry was actually requested.
+func (r *Retester) Retest(
+	ctx context.Context,
+	client ChecksClient,
+	pr PullRequest,
+	assignments *review.Assignments,
+	author string,
+	reviews []github.Review,
+	docs bool,
+	code bool,
+) (bool, error) {
+	if err := assignments.CheckInternal(author, reviews, docs, code); err != nil {
+		return false, nil
+	}
+
+	runs, err := client.ListCheckRuns(ctx, pr)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	var flaky []CheckRun
+	for _, run := range runs {
+		if run.Conclusion != "failure" {
+			continue
+		}
+		if r.isFlaky(run.Name) {
+			flaky = append(flaky, run)
+		}
+	}
+	if len(flaky) == 0 {
+		return false, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := pr.key()
+	e, ok := r.cache.Entries[key]
+	if !ok {
+		e = &entry{}
+		r.cache.Entries[key] = e
+	}
+
+	if e.Count >= r.c.MaxRetries {
+		return false, nil
+	}
+	if !e.LastRetry.IsZero() {
+		backoff := r.c.MinInterval * time.Duration(uint(1)<<uint(e.Count))
+		if time.Since(e.LastRetry) < backoff {
+			return false, nil
+		}
+	}
+
+	if !r.enabled(pr.Organization, pr.Repository) {
+		// Not yet enabled for this org/repo -- log-only.
+		log.Printf("retester: %v has %v flaky check(s) to retry, but is not enabled for %v/%v", pr.key(), len(flaky), pr.Organization, pr.Repository)
+		return false, nil
+	}
+
+	for _, run := range flaky {
+		if err := client.RerunCheckRun(ctx, pr, run.ID); err != nil {
+			return false, trace.Wrap(err)
+		}
+	}
+
+	e.Count++
+	e.LastRetry = time.Now()
+	if err := r.save(); err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	return true, nil
+}
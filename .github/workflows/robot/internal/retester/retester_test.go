@@ -0,0 +1,226 @@
+/*
+Copyright 2024 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retester
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport/.github/workflows/robot/internal/github"
+	"github.com/gravitational/teleport/.github/workflows/robot/internal/review"
+)
+
+// fakeChecksClient is a fake implementation of ChecksClient.
+type fakeChecksClient struct {
+	runs    []CheckRun
+	reruns  []int64
+	listErr error
+}
+
+func (f *fakeChecksClient) ListCheckRuns(ctx context.Context, pr PullRequest) ([]CheckRun, error) {
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	return f.runs, nil
+}
+
+func (f *fakeChecksClient) RerunCheckRun(ctx context.Context, pr PullRequest, checkRunID int64) error {
+	f.reruns = append(f.reruns, checkRunID)
+	return nil
+}
+
+func newTestAssignments() *review.Assignments {
+	a, err := review.FromString(`
+{
+	"codeReviewers": {
+		"1": { "team": "Core", "owner": true },
+		"2": { "team": "Core", "owner": true }
+	},
+	"codeReviewersOmit": {},
+	"docsReviewers": {},
+	"docsReviewersOmit": {},
+	"admins": ["1", "2"]
+}
+`)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func newTestRetester(t *testing.T) *Retester {
+	t.Helper()
+
+	r, err := New(Config{
+		CachePath:     filepath.Join(t.TempDir(), "cache.json"),
+		MaxRetries:    2,
+		MinInterval:   time.Minute,
+		FlakyPatterns: []string{`^flaky-.*$`},
+		EnableOnRepos: []string{"teleport"},
+	})
+	require.NoError(t, err)
+	return r
+}
+
+// TestRetestIncrementsAndCaps checks that a matching flaky failure is
+// retried, that the retry counter increments, and that MaxRetries is
+// enforced.
+func TestRetestIncrementsAndCaps(t *testing.T) {
+	r := newTestRetester(t)
+	assignments := newTestAssignments()
+	pr := PullRequest{Organization: "gravitational", Repository: "teleport", Number: 42}
+	reviews := []github.Review{
+		{Author: "1", State: "APPROVED"},
+		{Author: "2", State: "APPROVED"},
+	}
+
+	client := &fakeChecksClient{
+		runs: []CheckRun{
+			{ID: 1, Name: "flaky-integration", Conclusion: "failure"},
+			{ID: 2, Name: "unit", Conclusion: "success"},
+		},
+	}
+
+	for i := 0; i < r.c.MaxRetries; i++ {
+		retried, err := r.Retest(context.Background(), client, pr, assignments, "3", reviews, false, true)
+		require.NoError(t, err)
+		require.True(t, retried, "retry %v should be allowed", i)
+
+		r.cache.Entries[pr.key()].LastRetry = time.Time{}
+	}
+	require.Len(t, client.reruns, r.c.MaxRetries)
+
+	retried, err := r.Retest(context.Background(), client, pr, assignments, "3", reviews, false, true)
+	require.NoError(t, err)
+	require.False(t, retried, "retry beyond MaxRetries should be refused")
+	require.Len(t, client.reruns, r.c.MaxRetries)
+}
+
+// TestRetestCacheRoundTrip checks that retry state survives reloading the
+// cache from disk.
+func TestRetestCacheRoundTrip(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "cache.json")
+	assignments := newTestAssignments()
+	pr := PullRequest{Organization: "gravitational", Repository: "teleport", Number: 7}
+	reviews := []github.Review{
+		{Author: "1", State: "APPROVED"},
+		{Author: "2", State: "APPROVED"},
+	}
+	client := &fakeChecksClient{
+		runs: []CheckRun{{ID: 1, Name: "flaky-e2e", Conclusion: "failure"}},
+	}
+
+	r1, err := New(Config{
+		CachePath:     cachePath,
+		MaxRetries:    5,
+		MinInterval:   time.Minute,
+		FlakyPatterns: []string{`^flaky-.*$`},
+		EnableOnRepos: []string{"teleport"},
+	})
+	require.NoError(t, err)
+	retried, err := r1.Retest(context.Background(), client, pr, assignments, "3", reviews, false, true)
+	require.NoError(t, err)
+	require.True(t, retried)
+
+	r2, err := New(Config{
+		CachePath:     cachePath,
+		MaxRetries:    5,
+		MinInterval:   time.Minute,
+		FlakyPatterns: []string{`^flaky-.*$`},
+		EnableOnRepos: []string{"teleport"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, r2.cache.Entries[pr.key()].Count)
+
+	// Within MinInterval, a second retry should be refused.
+	retried, err = r2.Retest(context.Background(), client, pr, assignments, "3", reviews, false, true)
+	require.NoError(t, err)
+	require.False(t, retried)
+}
+
+// TestRetestSkipsWithdrawnApproval checks that a PR whose approval was
+// withdrawn (a changes-requested review after an earlier approval, as in
+// review.TestCheckInternal) is never retried.
+func TestRetestSkipsWithdrawnApproval(t *testing.T) {
+	r := newTestRetester(t)
+	assignments := newTestAssignments()
+	pr := PullRequest{Organization: "gravitational", Repository: "teleport", Number: 99}
+	reviews := []github.Review{
+		{Author: "1", State: "APPROVED"},
+		{Author: "2", State: "APPROVED"},
+		{Author: "2", State: "CHANGES_REQUESTED"},
+	}
+	client := &fakeChecksClient{
+		runs: []CheckRun{{ID: 1, Name: "flaky-integration", Conclusion: "failure"}},
+	}
+
+	retried, err := r.Retest(context.Background(), client, pr, assignments, "3", reviews, false, true)
+	require.NoError(t, err)
+	require.False(t, retried)
+	require.Empty(t, client.reruns)
+}
+
+// TestRetestIgnoresNonFlakyFailure checks that a failure not matching any
+// configured pattern is left alone.
+func TestRetestIgnoresNonFlakyFailure(t *testing.T) {
+	r := newTestRetester(t)
+	assignments := newTestAssignments()
+	pr := PullRequest{Organization: "gravitational", Repository: "teleport", Number: 100}
+	reviews := []github.Review{
+		{Author: "1", State: "APPROVED"},
+		{Author: "2", State: "APPROVED"},
+	}
+	client := &fakeChecksClient{
+		runs: []CheckRun{{ID: 1, Name: "lint", Conclusion: "failure"}},
+	}
+
+	retried, err := r.Retest(context.Background(), client, pr, assignments, "3", reviews, false, true)
+	require.NoError(t, err)
+	require.False(t, retried)
+	require.Empty(t, client.reruns)
+}
+
+// TestRetestNotEnabled checks that the retester logs-only (does not act)
+// outside the EnableOnRepos/EnableOnOrgs allow-list.
+func TestRetestNotEnabled(t *testing.T) {
+	r, err := New(Config{
+		CachePath:     filepath.Join(t.TempDir(), "cache.json"),
+		MaxRetries:    2,
+		MinInterval:   time.Minute,
+		FlakyPatterns: []string{`^flaky-.*$`},
+	})
+	require.NoError(t, err)
+
+	assignments := newTestAssignments()
+	pr := PullRequest{Organization: "gravitational", Repository: "teleport", Number: 101}
+	reviews := []github.Review{
+		{Author: "1", State: "APPROVED"},
+		{Author: "2", State: "APPROVED"},
+	}
+	client := &fakeChecksClient{
+		runs: []CheckRun{{ID: 1, Name: "flaky-integration", Conclusion: "failure"}},
+	}
+
+	retried, err := r.Retest(context.Background(), client, pr, assignments, "3", reviews, false, true)
+	require.NoError(t, err)
+	require.False(t, retried)
+	require.Empty(t, client.reruns)
+}
@@ -0,0 +1,430 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package review assigns and checks reviews on pull requests.
+package review
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gravitational/teleport/.github/workflows/robot/internal/github"
+	"github.com/gravitational/trace"
+)
+
+// Review state as reported by the GitHub API.
+const (
+	approved         = "APPROVED"
+	changesRequested = "CHANGES_REQUESTED"
+	commented        = "COMMENTED"
+)
+
+// Reviewer is a code or docs reviewer.
+type Reviewer struct {
+	// Team the reviewer belongs to, for example "Core", "Cloud", or
+	// "Internal".
+	Team string `json:"team"`
+	// Owner is true if the reviewer is a code/docs owner and can unblock a
+	// review on their own.
+	Owner bool `json:"owner"`
+}
+
+// CodeReviewRequirement enforces a minimum number of approvals, optionally
+// scoped to specific teams or logins, for any pull request that touches a
+// path matching PathPattern.
+type CodeReviewRequirement struct {
+	// PathPattern is a glob (as understood by filepath.Match, applied against
+	// each changed file) that this requirement applies to.
+	PathPattern string `json:"pathPattern"`
+	// MinReviewers is the minimum number of approvals required from
+	// Teams/Reviewers before this requirement is satisfied.
+	MinReviewers int `json:"minReviewers"`
+	// Teams, if set, restricts qualifying approvals to reviewers who belong
+	// to one of these teams (as defined in CodeReviewers).
+	Teams []string `json:"teams,omitempty"`
+	// Reviewers, if set, restricts qualifying approvals to these specific
+	// GitHub logins, in addition to any login that matches Teams.
+	Reviewers []string `json:"reviewers,omitempty"`
+}
+
+// Config is the configuration for code and docs reviewers.
+type Config struct {
+	// CodeReviewers and CodeReviewersOmit is a map of code reviewers and a
+	// map of code reviewers to omit, that is to not assign reviews to.
+	CodeReviewers     map[string]Reviewer `json:"codeReviewers"`
+	CodeReviewersOmit map[string]bool     `json:"codeReviewersOmit"`
+
+	// DocsReviewers and DocsReviewersOmit is a map of docs reviewers and a
+	// map of docs reviewers to omit, that is to not assign reviews to.
+	DocsReviewers     map[string]Reviewer `json:"docsReviewers"`
+	DocsReviewersOmit map[string]bool     `json:"docsReviewersOmit"`
+
+	// CodeReviewRequirements are additional, path-scoped requirements that
+	// are layered on top of the CodeReviewers/DocsReviewers defaults by
+	// CheckInternalWithFiles. When empty, CheckInternalWithFiles behaves
+	// exactly like CheckInternal.
+	CodeReviewRequirements []CodeReviewRequirement `json:"codeReviewRequirements,omitempty"`
+
+	// WorkflowReviewers are the GitHub logins that can approve changes
+	// under .github/workflows/ (see CheckInternalCategories).
+	WorkflowReviewers []string `json:"workflowReviewers,omitempty"`
+
+	// Admins are assigned reviews when no other reviewers are available,
+	// either as a fallback pool or to approve PRs from external contributors.
+	Admins []string `json:"admins"`
+}
+
+// CheckAndSetDefaults checks and sets default values.
+func (c *Config) CheckAndSetDefaults() error {
+	if c.CodeReviewers == nil {
+		c.CodeReviewers = map[string]Reviewer{}
+	}
+	if c.CodeReviewersOmit == nil {
+		c.CodeReviewersOmit = map[string]bool{}
+	}
+	if c.DocsReviewers == nil {
+		c.DocsReviewers = map[string]Reviewer{}
+	}
+	if c.DocsReviewersOmit == nil {
+		c.DocsReviewersOmit = map[string]bool{}
+	}
+	for i, req := range c.CodeReviewRequirements {
+		if req.PathPattern == "" {
+			return trace.BadParameter("codeReviewRequirements[%v]: pathPattern missing", i)
+		}
+		if req.MinReviewers <= 0 {
+			return trace.BadParameter("codeReviewRequirements[%v]: minReviewers must be greater than zero", i)
+		}
+	}
+	return nil
+}
+
+// Assignments can be used to assign and check reviews.
+type Assignments struct {
+	c *Config
+}
+
+// FromString parses JSON config from a string.
+func FromString(str string) (*Assignments, error) {
+	var c Config
+
+	if err := json.Unmarshal([]byte(str), &c); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := c.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &Assignments{
+		c: &c,
+	}, nil
+}
+
+// IsInternal returns true if the author of a PR is internal.
+func (r *Assignments) IsInternal(author string) bool {
+	_, codeOk := r.c.CodeReviewers[author]
+	_, docsOk := r.c.DocsReviewers[author]
+	return codeOk || docsOk
+}
+
+// CheckExternal requires all admins approve for external PRs.
+func (r *Assignments) CheckExternal(author string, reviews []github.Review) error {
+	states := latestReviewStates(reviews)
+
+	var approvedAdmins int
+	for _, admin := range r.c.Admins {
+		if states[admin] == approved {
+			approvedAdmins++
+		}
+	}
+
+	if approvedAdmins < len(r.c.Admins) {
+		return trace.BadParameter("all %v admin(s) must approve external PRs: %v", len(r.c.Admins), r.c.Admins)
+	}
+	return nil
+}
+
+// CheckInternal checks if required reviewers have approved. Checks if docs
+// reviewers have approved if any docs files have been changed. Checks if
+// code reviewers have approved if any code files have been changed.
+func (r *Assignments) CheckInternal(author string, reviews []github.Review, docs bool, code bool) error {
+	if !docs && !code {
+		return trace.BadParameter("requires at least one approval")
+	}
+
+	states := latestReviewStates(reviews)
+
+	if docs {
+		if !r.checkDocsApproval(author, states) {
+			return trace.BadParameter("requires approval from docs reviewers")
+		}
+	}
+	if code {
+		if err := r.checkCodeApproval(author, states); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// CheckInternalWithFiles is like CheckInternal, but additionally enforces
+// any path-scoped CodeReviewRequirements that match the given changed files.
+// When no requirements are configured, it is equivalent to CheckInternal.
+func (r *Assignments) CheckInternalWithFiles(author string, reviews []github.Review, docs bool, code bool, files []string) error {
+	if err := r.CheckInternal(author, reviews, docs, code); err != nil {
+		return trace.Wrap(err)
+	}
+
+	reqs := matchingRequirements(r.c.CodeReviewRequirements, files)
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	states := latestReviewStates(reviews)
+	for _, req := range reqs {
+		if err := r.checkRequirement(author, states, req); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// matchingRequirements returns every requirement whose PathPattern matches
+// at least one of files. When multiple requirements match the same file, all
+// of them apply (the union is enforced), so the caller must satisfy every
+// returned requirement.
+func matchingRequirements(reqs []CodeReviewRequirement, files []string) []CodeReviewRequirement {
+	var matched []CodeReviewRequirement
+	for _, req := range reqs {
+		for _, file := range files {
+			if ok, _ := filepath.Match(req.PathPattern, file); ok {
+				matched = append(matched, req)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// checkRequirement verifies a single CodeReviewRequirement has been
+// satisfied by the given review states.
+func (r *Assignments) checkRequirement(author string, states map[string]string, req CodeReviewRequirement) error {
+	teams := map[string]bool{}
+	for _, team := range req.Teams {
+		teams[team] = true
+	}
+	logins := map[string]bool{}
+	for _, login := range req.Reviewers {
+		logins[login] = true
+	}
+
+	var approvals int
+	for login, reviewer := range r.c.CodeReviewers {
+		if login == author {
+			continue
+		}
+		if r.c.CodeReviewersOmit[login] {
+			continue
+		}
+		if states[login] != approved {
+			continue
+		}
+		qualifies := (len(teams) == 0 && len(logins) == 0) || logins[login] || teams[reviewer.Team]
+		if !qualifies {
+			continue
+		}
+		approvals++
+	}
+
+	if approvals < req.MinReviewers {
+		return trace.BadParameter("path %v requires %v approval(s), have %v", req.PathPattern, req.MinReviewers, approvals)
+	}
+	return nil
+}
+
+// checkDocsApproval checks if an approval from a docs reviewer exists.
+func (r *Assignments) checkDocsApproval(author string, states map[string]string) bool {
+	for login := range r.c.DocsReviewers {
+		if login == author {
+			continue
+		}
+		if r.c.DocsReviewersOmit[login] {
+			continue
+		}
+		if states[login] == approved {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCodeApproval checks if a PR has been approved by at least one code
+// owner and at least one additional code reviewer (who may also be an
+// owner).
+func (r *Assignments) checkCodeApproval(author string, states map[string]string) error {
+	var total, owners int
+	for login, reviewer := range r.c.CodeReviewers {
+		if login == author {
+			continue
+		}
+		if r.c.CodeReviewersOmit[login] {
+			continue
+		}
+		if states[login] != approved {
+			continue
+		}
+		total++
+		if reviewer.Owner {
+			owners++
+		}
+	}
+
+	if owners < 1 || total < 2 {
+		return trace.BadParameter("requires at least one approval from a code owner and one additional approval")
+	}
+	return nil
+}
+
+// getCodeReviewerSets returns the set of code reviewers that can be
+// assigned to a PR, as two sets: Core team owners (setA) and non-owners
+// (setB) for "Core" and "Cloud" authors, or the admin pool split in half
+// for everyone else.
+func (r *Assignments) getCodeReviewerSets(author string) ([]string, []string) {
+	reviewer := r.c.CodeReviewers[author]
+
+	switch reviewer.Team {
+	case "Core", "Cloud":
+		return r.getCoreReviewerSets(author)
+	default:
+		return r.getDefaultReviewerSets()
+	}
+}
+
+// getCoreReviewerSets returns all Core team reviewers, split into owners
+// and non-owners, excluding the author and any omitted reviewers.
+func (r *Assignments) getCoreReviewerSets(author string) ([]string, []string) {
+	var setA, setB []string
+
+	for login, reviewer := range r.c.CodeReviewers {
+		if login == author {
+			continue
+		}
+		if r.c.CodeReviewersOmit[login] {
+			continue
+		}
+		if reviewer.Team != "Core" {
+			continue
+		}
+		if reviewer.Owner {
+			setA = append(setA, login)
+		} else {
+			setB = append(setB, login)
+		}
+	}
+
+	return setA, setB
+}
+
+// getDefaultReviewerSets splits the admin pool in half for authors that do
+// not belong to a reviewing team (for example external or "Internal"
+// contributors).
+func (r *Assignments) getDefaultReviewerSets() ([]string, []string) {
+	admins := append([]string{}, r.c.Admins...)
+	sort.Strings(admins)
+
+	mid := (len(admins) + 1) / 2
+	return admins[:mid], admins[mid:]
+}
+
+// getDocsReviewers returns the docs reviewers that can be assigned to a PR,
+// falling back to the admin pool if none are left after excluding the
+// author and any omitted reviewers.
+func (r *Assignments) getDocsReviewers(author string) []string {
+	var reviewers []string
+
+	for login := range r.c.DocsReviewers {
+		if login == author {
+			continue
+		}
+		if r.c.DocsReviewersOmit[login] {
+			continue
+		}
+		reviewers = append(reviewers, login)
+	}
+
+	if len(reviewers) == 0 {
+		reviewers = append(reviewers, r.c.Admins...)
+	}
+
+	return reviewers
+}
+
+// latestReviewStates returns, for each author, the state of their most
+// recent review, ignoring comment-only reviews (which neither approve nor
+// request changes).
+func latestReviewStates(reviews []github.Review) map[string]string {
+	states := map[string]string{}
+	for _, review := range reviews {
+		if review.State == commented {
+			continue
+		}
+		states[review.Author] = review.State
+	}
+	return states
+}
+
+// changedFiles is a narrow interface over the github client so that
+// CheckInternalWithFiles callers can fetch the list of files a PR changed.
+type changedFiles interface {
+	ListFiles(ctx context.Context, organization string, repository string, number int) ([]string, error)
+}
+
+// GetReviewersForAssign assigns docs and/or code reviewers to a PR for the
+// given author, based on the set of files the PR has changed.
+func (r *Assignments) GetReviewersForAssign(ctx context.Context, client changedFiles, author string, organization string, repository string, number int) ([]string, error) {
+	files, err := client.ListFiles(ctx, organization, repository, number)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var reviewers []string
+	docs, code := classifyFiles(files)
+	if docs {
+		reviewers = append(reviewers, r.getDocsReviewers(author)...)
+	}
+	if code {
+		setA, setB := r.getCodeReviewerSets(author)
+		reviewers = append(reviewers, setA...)
+		reviewers = append(reviewers, setB...)
+	}
+	return reviewers, nil
+}
+
+// classifyFiles reports whether the given files contain any docs changes
+// and/or any code changes.
+func classifyFiles(files []string) (docs bool, code bool) {
+	for _, file := range files {
+		if strings.HasPrefix(file, "docs/") {
+			docs = true
+			continue
+		}
+		code = true
+	}
+	return docs, code
+}
@@ -736,6 +736,101 @@ func TestFromString(t *testing.T) {
 	})
 }
 
+// TestCheckInternalWithFiles checks that path-scoped CodeReviewRequirements
+// are enforced on top of the default docs/code approval rules, and that
+// overlapping requirements enforce the strictest (union) set of approvals.
+func TestCheckInternalWithFiles(t *testing.T) {
+	r := &Assignments{
+		c: &Config{
+			CodeReviewers: map[string]Reviewer{
+				"1": {Team: "Core", Owner: true},
+				"2": {Team: "Core", Owner: true},
+				"3": {Team: "Security", Owner: true},
+			},
+			CodeReviewersOmit: map[string]bool{},
+			DocsReviewers: map[string]Reviewer{
+				"4": {Team: "Core", Owner: true},
+			},
+			DocsReviewersOmit: map[string]bool{},
+			Admins: []string{
+				"1",
+				"2",
+			},
+			CodeReviewRequirements: []CodeReviewRequirement{
+				{
+					PathPattern:  "lib/auth/*",
+					MinReviewers: 2,
+					Teams:        []string{"Core"},
+				},
+				{
+					PathPattern:  "lib/auth/*",
+					MinReviewers: 1,
+					Teams:        []string{"Security"},
+				},
+				{
+					PathPattern:  "docs/*",
+					MinReviewers: 1,
+				},
+			},
+		},
+	}
+	tests := []struct {
+		desc    string
+		author  string
+		reviews []github.Review
+		files   []string
+		ok      bool
+	}{
+		{
+			desc:    "no-matching-path-falls-back-to-default",
+			author:  "5",
+			reviews: []github.Review{{Author: "1", State: approved}, {Author: "2", State: approved}},
+			files:   []string{"lib/srv/exec.go"},
+			ok:      true,
+		},
+		{
+			desc:    "overlapping-policy-missing-security-approval-fails",
+			author:  "5",
+			reviews: []github.Review{{Author: "1", State: approved}, {Author: "2", State: approved}},
+			files:   []string{"lib/auth/auth.go"},
+			ok:      false,
+		},
+		{
+			desc:   "overlapping-policy-missing-core-approvals-fails",
+			author: "5",
+			reviews: []github.Review{
+				{Author: "1", State: approved},
+				{Author: "3", State: approved},
+			},
+			files: []string{"lib/auth/auth.go"},
+			ok:    false,
+		},
+		{
+			desc:   "overlapping-policy-satisfied",
+			author: "5",
+			reviews: []github.Review{
+				{Author: "1", State: approved},
+				{Author: "2", State: approved},
+				{Author: "3", State: approved},
+			},
+			files: []string{"lib/auth/auth.go"},
+			ok:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			err := r.CheckInternalWithFiles(test.author, test.reviews, false, true, test.files)
+			if test.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
 const reviewers = `
 {
 	"codeReviewers": {
@@ -0,0 +1,153 @@
+/*
+Copyright 2024 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/rhysd/actionlint"
+
+	"github.com/gravitational/teleport/.github/workflows/robot/internal/github"
+	"github.com/gravitational/trace"
+)
+
+// ChangeCategories classifies the files a pull request has changed, so that
+// CheckInternalCategories can compose the right set of required approvals.
+type ChangeCategories struct {
+	// Docs is true if the PR changes documentation.
+	Docs bool
+	// Code is true if the PR changes code.
+	Code bool
+	// Workflows is true if the PR changes files under .github/workflows/.
+	Workflows bool
+}
+
+// CheckInternalCategories is like CheckInternal, but additionally requires
+// an approval from one of the WorkflowReviewers when the PR touches
+// workflow files.
+func (r *Assignments) CheckInternalCategories(author string, reviews []github.Review, categories ChangeCategories) error {
+	if categories.Docs || categories.Code || !categories.Workflows {
+		if err := r.CheckInternal(author, reviews, categories.Docs, categories.Code); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	if categories.Workflows {
+		states := latestReviewStates(reviews)
+		if !r.checkWorkflowApproval(author, states) {
+			return trace.BadParameter("requires approval from workflow reviewers")
+		}
+	}
+
+	return nil
+}
+
+// checkWorkflowApproval checks if an approval from a configured workflow
+// reviewer exists.
+func (r *Assignments) checkWorkflowApproval(author string, states map[string]string) bool {
+	for _, login := range r.c.WorkflowReviewers {
+		if login == author {
+			continue
+		}
+		if states[login] == approved {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWorkflowFile reports whether path is a GitHub Actions workflow file.
+func IsWorkflowFile(path string) bool {
+	if !strings.HasPrefix(path, ".github/workflows/") {
+		return false
+	}
+	return strings.HasSuffix(path, ".yml") || strings.HasSuffix(path, ".yaml")
+}
+
+// WorkflowFinding is a single actionlint finding on a workflow file.
+type WorkflowFinding struct {
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// LintWorkflows runs actionlint against the contents of each changed
+// workflow file (keyed by repository-relative path) and returns any
+// findings, ordered by path (files is a map, so paths are sorted first to
+// keep the result deterministic).
+func LintWorkflows(files map[string][]byte) ([]WorkflowFinding, error) {
+	linter, err := actionlint.NewLinter(nopWriter{}, &actionlint.LinterOptions{})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var findings []WorkflowFinding
+	for _, path := range paths {
+		if !IsWorkflowFile(path) {
+			continue
+		}
+
+		errs, err := linter.Lint(path, files[path], nil)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		for _, e := range errs {
+			findings = append(findings, WorkflowFinding{
+				Path:    path,
+				Line:    e.Line,
+				Column:  e.Column,
+				Message: e.Message,
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+// commentPoster is the subset of the github client used to post inline
+// review comments.
+type commentPoster interface {
+	CreateReviewComment(ctx context.Context, organization string, repository string, number int, path string, line int, body string) error
+}
+
+// PostWorkflowFindings posts each finding as an inline review comment on
+// the pull request.
+func PostWorkflowFindings(ctx context.Context, client commentPoster, organization string, repository string, number int, findings []WorkflowFinding) error {
+	for _, finding := range findings {
+		if err := client.CreateReviewComment(ctx, organization, repository, number, finding.Path, finding.Line, finding.Message); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// nopWriter discards actionlint's own debug/progress output; the bot only
+// cares about the structured findings returned by Lint.
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2024 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport/.github/workflows/robot/internal/github"
+)
+
+// TestCheckInternalCategories checks that workflow-only and mixed
+// code+workflow PRs require the right set of approvals.
+func TestCheckInternalCategories(t *testing.T) {
+	r := &Assignments{
+		c: &Config{
+			CodeReviewers: map[string]Reviewer{
+				"1": {Team: "Core", Owner: true},
+				"2": {Team: "Core", Owner: true},
+				"3": {Team: "Core", Owner: false},
+			},
+			CodeReviewersOmit: map[string]bool{},
+			DocsReviewers:     map[string]Reviewer{},
+			DocsReviewersOmit: map[string]bool{},
+			WorkflowReviewers: []string{"9"},
+			Admins:            []string{"1", "2"},
+		},
+	}
+	tests := []struct {
+		desc       string
+		author     string
+		reviews    []github.Review
+		categories ChangeCategories
+		ok         bool
+	}{
+		{
+			desc:       "workflow-only-no-approval-fails",
+			author:     "4",
+			reviews:    []github.Review{},
+			categories: ChangeCategories{Workflows: true},
+			ok:         false,
+		},
+		{
+			desc:   "workflow-only-non-workflow-approval-fails",
+			author: "4",
+			reviews: []github.Review{
+				{Author: "1", State: approved},
+			},
+			categories: ChangeCategories{Workflows: true},
+			ok:         false,
+		},
+		{
+			desc:   "workflow-only-workflow-approval-succeeds",
+			author: "4",
+			reviews: []github.Review{
+				{Author: "9", State: approved},
+			},
+			categories: ChangeCategories{Workflows: true},
+			ok:         true,
+		},
+		{
+			desc:   "code-and-workflow-requires-both",
+			author: "4",
+			reviews: []github.Review{
+				{Author: "1", State: approved},
+			},
+			categories: ChangeCategories{Code: true, Workflows: true},
+			ok:         false,
+		},
+		{
+			desc:   "code-and-workflow-both-approved-succeeds",
+			author: "4",
+			reviews: []github.Review{
+				{Author: "1", State: approved},
+				{Author: "3", State: approved},
+				{Author: "9", State: approved},
+			},
+			categories: ChangeCategories{Code: true, Workflows: true},
+			ok:         true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			err := r.CheckInternalCategories(test.author, test.reviews, test.categories)
+			if test.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+// TestIsWorkflowFile checks path classification for actionlint gating.
+func TestIsWorkflowFile(t *testing.T) {
+	require.True(t, IsWorkflowFile(".github/workflows/ci.yaml"))
+	require.True(t, IsWorkflowFile(".github/workflows/ci.yml"))
+	require.False(t, IsWorkflowFile(".github/CODEOWNERS"))
+	require.False(t, IsWorkflowFile("lib/auth/auth.go"))
+}
+
+// TestLintWorkflows checks that actionlint findings are surfaced for an
+// invalid workflow file and not for non-workflow files.
+func TestLintWorkflows(t *testing.T) {
+	findings, err := LintWorkflows(map[string][]byte{
+		".github/workflows/ci.yaml": []byte("on: push\njobs:\n  build:\n    runs-on: ubuntu-latest\n    steps:\n      - run: echo ${{ invalid. }}\n"),
+		"lib/auth/auth.go":          []byte("package auth\n"),
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, findings)
+	for _, finding := range findings {
+		require.Equal(t, ".github/workflows/ci.yaml", finding.Path)
+	}
+}
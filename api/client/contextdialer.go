@@ -17,9 +17,13 @@ limitations under the License.
 package client
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gravitational/teleport/api/client/proxy"
@@ -54,11 +58,16 @@ func newDirectDialer(keepAlivePeriod, dialTimeout time.Duration) ContextDialer {
 	}
 }
 
-// NewDialer makes a new dialer that connects to an Auth server either directly or via an HTTP proxy, depending
-// on the environment.
-func NewDialer(keepAlivePeriod, dialTimeout time.Duration, tlsConfig *tls.Config) ContextDialer {
+// dialWithEnvProxy wraps dialer so that, when an HTTP_PROXY/HTTPS_PROXY is
+// configured for addr in the environment, the underlying TCP connection is
+// established via an HTTP CONNECT tunnel to that proxy (see
+// DialProxyWithDialer) instead of dialing addr directly. Every dialer in
+// this file except newHTTPConnectTunnelDialer funnels through here, so
+// env-proxy support composes uniformly
+// with whatever comes next (a raw SSH handshake, a TLS handshake, or an ALPN
+// connection upgrade).
+func dialWithEnvProxy(dialer ContextDialer) ContextDialer {
 	return ContextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
-		dialer := newDirectOrHTTPConnUpgradeDialer(addr, keepAlivePeriod, dialTimeout, tlsConfig)
 		if proxyURL := proxy.GetProxyURL(addr); proxyURL != nil {
 			return DialProxyWithDialer(ctx, proxyURL, addr, dialer)
 		}
@@ -66,28 +75,228 @@ func NewDialer(keepAlivePeriod, dialTimeout time.Duration, tlsConfig *tls.Config
 	})
 }
 
+// DialerOption configures the optional settings accepted by NewDialer,
+// newTunnelDialer, newTLSRoutingTunnelDialer and
+// newDirectOrHTTPConnUpgradeDialer.
+type DialerOption func(*dialerOptions)
+
+// dialerOptions are the optional settings configured via DialerOption.
+type dialerOptions struct {
+	// baseDialer, if set, is used as the underlying transport in place of a
+	// freshly constructed net.Dialer.
+	baseDialer ContextDialer
+	// idleTimeout, if non-zero, overrides defaultIdleTimeout for connections
+	// returned by the dialer.
+	idleTimeout time.Duration
+}
+
+// WithBaseDialer overrides the net.Dialer a ContextDialer would otherwise
+// construct for itself with base. This lets callers tunnel Teleport
+// connections through a transport of their own choosing (a SOCKS5 proxy, an
+// existing stream, a test double), while still getting the env-proxy and
+// ALPN/TLS Routing handling the dialers in this file provide. It applies
+// equally to dialers that require an HTTP connection upgrade: the upgrade
+// runs on top of base, rather than base being bypassed.
+func WithBaseDialer(base ContextDialer) DialerOption {
+	return func(o *dialerOptions) {
+		o.baseDialer = base
+	}
+}
+
+func resolveDialerOptions(opts ...DialerOption) dialerOptions {
+	var options dialerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// defaultIdleTimeout is the idle timeout applied to connections returned by
+// the dialers in this file when no WithIdleTimeout option is given. It
+// matches typical NLB/HTTP-proxy idle timeouts, so a connection that's
+// silently dropped in between doesn't leak indefinitely on the agent side.
+const defaultIdleTimeout = 360 * time.Second
+
+// WithIdleTimeout overrides defaultIdleTimeout for connections returned by
+// the dialer: if no Read or Write succeeds within timeout, subsequent I/O on
+// the connection fails instead of hanging or leaking indefinitely.
+func WithIdleTimeout(timeout time.Duration) DialerOption {
+	return func(o *dialerOptions) {
+		o.idleTimeout = timeout
+	}
+}
+
+// idleTimeoutConn wraps a net.Conn, closing it if no Read or Write succeeds
+// within idleTimeout. This is enforced with an explicit timer rather than
+// SetReadDeadline/SetWriteDeadline, since some of the conns wrapped here
+// (e.g. the SSH-channel-backed conn sshConnect returns) don't honor
+// deadlines at all, which would otherwise make idle enforcement a silent
+// no-op on those paths.
+type idleTimeoutConn struct {
+	net.Conn
+	idleTimeout time.Duration
+	timer       *time.Timer
+}
+
+// wrapWithIdleTimeout wraps conn in an idleTimeoutConn, using defaultIdleTimeout
+// if idleTimeout is zero.
+func wrapWithIdleTimeout(conn net.Conn, idleTimeout time.Duration) net.Conn {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	c := &idleTimeoutConn{
+		Conn:        conn,
+		idleTimeout: idleTimeout,
+		timer:       time.AfterFunc(idleTimeout, func() { conn.Close() }),
+	}
+	return c
+}
+
+func (c *idleTimeoutConn) extend() {
+	c.timer.Reset(c.idleTimeout)
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err == nil {
+		c.extend()
+	}
+	return n, err
+}
+
+// Close stops the idle timer before closing the underlying conn, so it
+// doesn't fire (redundantly) after the caller has already closed it.
+func (c *idleTimeoutConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// NewDialer makes a new dialer that connects to an Auth server either directly or via an HTTP proxy, depending
+// on the environment.
+func NewDialer(keepAlivePeriod, dialTimeout time.Duration, tlsConfig *tls.Config, opts ...DialerOption) ContextDialer {
+	options := resolveDialerOptions(opts...)
+	return ContextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialer := newDirectOrHTTPConnUpgradeDialer(addr, keepAlivePeriod, dialTimeout, tlsConfig, opts...)
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return wrapWithIdleTimeout(conn, options.idleTimeout), nil
+	})
+}
+
+// tunnelAddrCacheTTL is how long a tunnel address discovered via
+// webclient.GetTunnelAddr (successful or not) is cached for, before the next
+// dial re-pings the proxy's /webapi/ping. It's a var, not a const, so tests
+// can shorten it.
+var tunnelAddrCacheTTL = 30 * time.Second
+
+// tunnelAddrCache deduplicates and caches webclient.GetTunnelAddr lookups,
+// keyed by discoveryAddr, so high-churn reconnects against the same proxy
+// share one lookup instead of each paying for an extra HTTPS round-trip.
+// Failed lookups are cached too, so a proxy that's down doesn't get hammered
+// by every reconnect attempt; Invalidate lets a caller whose subsequent dial
+// fails evict the entry immediately, so the next attempt rediscovers the
+// tunnel address (e.g. after proxy failover) instead of waiting out the TTL.
+type tunnelAddrCache struct {
+	mu      sync.Mutex
+	entries map[string]*tunnelAddrCacheEntry
+}
+
+type tunnelAddrCacheEntry struct {
+	addr    string
+	err     error
+	expires time.Time
+	done    chan struct{}
+}
+
+func (e *tunnelAddrCacheEntry) loaded() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+var globalTunnelAddrCache = &tunnelAddrCache{entries: make(map[string]*tunnelAddrCacheEntry)}
+
+// get returns the cached result of lookup(discoveryAddr), issuing a fresh
+// call only if no entry exists or the existing one has expired. Concurrent
+// calls for the same discoveryAddr while a lookup is in flight block on that
+// single call rather than each starting their own.
+func (c *tunnelAddrCache) get(ctx context.Context, discoveryAddr string, lookup func(ctx context.Context) (string, error)) (string, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[discoveryAddr]; ok {
+		if !e.loaded() {
+			c.mu.Unlock()
+			<-e.done
+			return e.addr, e.err
+		}
+		if time.Now().Before(e.expires) {
+			c.mu.Unlock()
+			return e.addr, e.err
+		}
+		delete(c.entries, discoveryAddr)
+	}
+	e := &tunnelAddrCacheEntry{done: make(chan struct{})}
+	c.entries[discoveryAddr] = e
+	c.mu.Unlock()
+
+	e.addr, e.err = lookup(ctx)
+	e.expires = time.Now().Add(tunnelAddrCacheTTL)
+	close(e.done)
+	return e.addr, e.err
+}
+
+// invalidate evicts any cached entry for discoveryAddr, so the next get
+// rediscovers the tunnel address instead of returning one that just failed
+// to connect.
+func (c *tunnelAddrCache) invalidate(discoveryAddr string) {
+	c.mu.Lock()
+	delete(c.entries, discoveryAddr)
+	c.mu.Unlock()
+}
+
 // NewProxyDialer makes a dialer to connect to an Auth server through the SSH reverse tunnel on the proxy.
 // The dialer will ping the web client to discover the tunnel proxy address on each dial.
-func NewProxyDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeout time.Duration, discoveryAddr string, insecure bool) ContextDialer {
-	dialer := newTunnelDialer(ssh, keepAlivePeriod, dialTimeout)
+func NewProxyDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeout time.Duration, discoveryAddr string, insecure bool, opts ...DialerOption) ContextDialer {
+	options := resolveDialerOptions(opts...)
+	dialer := newTunnelDialer(ssh, keepAlivePeriod, dialTimeout, opts...)
 	return ContextDialerFunc(func(ctx context.Context, network, _ string) (conn net.Conn, err error) {
-		tunnelAddr, err := webclient.GetTunnelAddr(
-			&webclient.Config{Context: ctx, ProxyAddr: discoveryAddr, Insecure: insecure})
+		tunnelAddr, err := globalTunnelAddrCache.get(ctx, discoveryAddr, func(ctx context.Context) (string, error) {
+			return webclient.GetTunnelAddr(
+				&webclient.Config{Context: ctx, ProxyAddr: discoveryAddr, Insecure: insecure})
+		})
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
 
 		conn, err = dialer.DialContext(ctx, network, tunnelAddr)
 		if err != nil {
+			globalTunnelAddrCache.invalidate(discoveryAddr)
 			return nil, trace.Wrap(err)
 		}
-		return conn, nil
+		return wrapWithIdleTimeout(conn, options.idleTimeout), nil
 	})
 }
 
 // newTunnelDialer makes a dialer to connect to an Auth server through the SSH reverse tunnel on the proxy.
-func newTunnelDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeout time.Duration) ContextDialer {
-	dialer := newDirectDialer(keepAlivePeriod, dialTimeout)
+func newTunnelDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeout time.Duration, opts ...DialerOption) ContextDialer {
+	options := resolveDialerOptions(opts...)
+	base := options.baseDialer
+	if base == nil {
+		base = newDirectDialer(keepAlivePeriod, dialTimeout)
+	}
+	dialer := dialWithEnvProxy(base)
 	return ContextDialerFunc(func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
 		conn, err = dialer.DialContext(ctx, network, addr)
 		if err != nil {
@@ -102,12 +311,98 @@ func newTunnelDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeout time.Dur
 	})
 }
 
+// httpConnectAuthFunc returns the value to send as the bearer token in the
+// Proxy-Authorization header of an HTTP CONNECT tunnel request (normally a
+// signed host cert JWT). It's supplied by the caller, since minting that
+// token needs Auth-side signing material this package doesn't have.
+type httpConnectAuthFunc func(ctx context.Context) (string, error)
+
+// newHTTPConnectTunnelDialer makes a dialer that reaches the Auth server
+// through a plain HTTP CONNECT reverse tunnel, rather than the SSH-based one
+// used by newTunnelDialer: it performs the ALPN upgrade handshake against
+// the proxy at discoveryAddr, issues a
+// "CONNECT <constants.RemoteAuthServer>:0 HTTP/1.1" authenticated with a
+// Teleport-specific Proxy-Authorization bearer, and returns the raw tunneled
+// net.Conn. This mirrors the HTTP CONNECT tunneling already used for trusted
+// clusters, and gives operators a lighter-weight alternative to the SSH
+// reverse tunnel where SSH handshake overhead or key management is
+// undesirable.
+func newHTTPConnectTunnelDialer(tlsConfig *tls.Config, discoveryAddr string, insecure bool, getAuth httpConnectAuthFunc) ContextDialer {
+	return ContextDialerFunc(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		tunnelAddr, err := globalTunnelAddrCache.get(ctx, discoveryAddr, func(ctx context.Context) (string, error) {
+			return webclient.GetTunnelAddr(
+				&webclient.Config{Context: ctx, ProxyAddr: discoveryAddr, Insecure: insecure})
+		})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		host, _, err := webclient.ParseHostPort(tunnelAddr)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		dialer := tls.Dialer{Config: &tls.Config{
+			NextProtos:         []string{constants.ALPNSNIProtocolReverseTunnel},
+			InsecureSkipVerify: insecure,
+			ServerName:         host,
+		}}
+		conn, err := dialer.DialContext(ctx, network, tunnelAddr)
+		if err != nil {
+			globalTunnelAddrCache.invalidate(discoveryAddr)
+			return nil, trace.Wrap(err)
+		}
+
+		if err := httpConnect(ctx, conn, fmt.Sprintf("%v:0", constants.RemoteAuthServer), getAuth); err != nil {
+			conn.Close()
+			globalTunnelAddrCache.invalidate(discoveryAddr)
+			return nil, trace.Wrap(err)
+		}
+		return conn, nil
+	})
+}
+
+// httpConnect tunnels to target over conn via a single HTTP CONNECT request,
+// authenticated with the bearer token returned by getAuth, leaving conn
+// ready for raw use (e.g. as a gRPC transport) if it succeeds.
+func httpConnect(ctx context.Context, conn net.Conn, target string, getAuth httpConnectAuthFunc) error {
+	auth, err := getAuth(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, "//"+target, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	req.Host = target
+	req.Header.Set("Proxy-Authorization", "Bearer "+auth)
+
+	if err := req.Write(conn); err != nil {
+		return trace.Wrap(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return trace.BadParameter("HTTP CONNECT tunnel to %v failed: %v", target, resp.Status)
+	}
+	return nil
+}
+
 // newTLSRoutingTunnelDialer makes a reverse tunnel TLS Routing dialer to connect to an Auth server
 // through the SSH reverse tunnel on the proxy.
-func newTLSRoutingTunnelDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeout time.Duration, discoveryAddr string, insecure bool) ContextDialer {
+func newTLSRoutingTunnelDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeout time.Duration, discoveryAddr string, insecure bool, opts ...DialerOption) ContextDialer {
+	options := resolveDialerOptions(opts...)
 	return ContextDialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
-		tunnelAddr, err := webclient.GetTunnelAddr(
-			&webclient.Config{Context: ctx, ProxyAddr: discoveryAddr, Insecure: insecure})
+		tunnelAddr, err := globalTunnelAddrCache.get(ctx, discoveryAddr, func(ctx context.Context) (string, error) {
+			return webclient.GetTunnelAddr(
+				&webclient.Config{Context: ctx, ProxyAddr: discoveryAddr, Insecure: insecure})
+		})
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
@@ -118,6 +413,8 @@ func newTLSRoutingTunnelDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeou
 		}
 
 		tlsDialer := TLSRoutingDialer{
+			BaseDialer:      options.baseDialer,
+			IdleTimeout:     options.idleTimeout,
 			KeepAlivePeriod: keepAlivePeriod,
 			DialTimeout:     dialTimeout,
 			Config: &tls.Config{
@@ -128,14 +425,16 @@ func newTLSRoutingTunnelDialer(ssh ssh.ClientConfig, keepAlivePeriod, dialTimeou
 		}
 		tlsConn, err := tlsDialer.DialContext(ctx, network, tunnelAddr)
 		if err != nil {
+			globalTunnelAddrCache.invalidate(discoveryAddr)
 			return nil, trace.Wrap(err)
 		}
 
 		sconn, err := sshConnect(ctx, tlsConn, ssh, dialTimeout, tunnelAddr)
 		if err != nil {
+			globalTunnelAddrCache.invalidate(discoveryAddr)
 			return nil, trace.Wrap(err)
 		}
-		return sconn, nil
+		return wrapWithIdleTimeout(sconn, options.idleTimeout), nil
 	})
 }
 
@@ -158,17 +457,40 @@ func sshConnect(ctx context.Context, conn net.Conn, ssh ssh.ClientConfig, dialTi
 	return conn, nil
 }
 
-// TODO
-func newDirectOrHTTPConnUpgradeDialer(proxyAddr string, keepAlivePeriod, dialTimeout time.Duration, tlsConfig *tls.Config) ContextDialer {
-	if isHTTPConnUpgradeRequired(proxyAddr, tlsConfig) {
-		return newHTTPConnUpgradeDialer(tlsConfig.InsecureSkipVerify)
+// newDirectOrHTTPConnUpgradeDialer makes a dialer that connects directly to
+// proxyAddr, unless the server at proxyAddr requires an ALPN connection
+// upgrade (e.g. it sits behind a load balancer that doesn't forward ALPN),
+// in which case it returns a dialer that performs that upgrade instead. In
+// both cases, the underlying transport is established first (honoring
+// WithBaseDialer and any HTTP_PROXY/HTTPS_PROXY configured in the
+// environment), so an ALPN connection upgrade runs over the CONNECT-tunneled
+// conn rather than attempting the upgrade against the proxy itself.
+func newDirectOrHTTPConnUpgradeDialer(proxyAddr string, keepAlivePeriod, dialTimeout time.Duration, tlsConfig *tls.Config, opts ...DialerOption) ContextDialer {
+	base := resolveDialerOptions(opts...).baseDialer
+	if base == nil {
+		base = newDirectDialer(keepAlivePeriod, dialTimeout)
 	}
+	base = dialWithEnvProxy(base)
 
-	return newDirectDialer(keepAlivePeriod, dialTimeout)
+	if isHTTPConnUpgradeRequired(proxyAddr, tlsConfig) {
+		return newHTTPConnUpgradeDialer(base, tlsConfig.InsecureSkipVerify)
+	}
+	return base
 }
 
-// TODO
+// TLSRoutingDialer dials an Auth/Proxy server and performs the TLS handshake
+// (and, where required, the ALPN connection upgrade) needed for TLS Routing,
+// honoring any HTTP_PROXY/HTTPS_PROXY configured in the environment first.
 type TLSRoutingDialer struct {
+	// BaseDialer, if set, replaces the net.Dialer this dialer would otherwise
+	// construct. When the ALPN connection upgrade is required, the upgrade
+	// runs on top of BaseDialer.
+	BaseDialer ContextDialer
+
+	// IdleTimeout, if non-zero, overrides defaultIdleTimeout for the
+	// returned connection.
+	IdleTimeout time.Duration
+
 	KeepAlivePeriod time.Duration
 	DialTimeout     time.Duration
 	Config          *tls.Config
@@ -179,7 +501,11 @@ func (d *TLSRoutingDialer) DialContext(ctx context.Context, network, addr string
 		return nil, trace.BadParameter("missing TLS config")
 	}
 
-	dialer := newDirectOrHTTPConnUpgradeDialer(addr, d.KeepAlivePeriod, d.DialTimeout, d.Config)
+	var opts []DialerOption
+	if d.BaseDialer != nil {
+		opts = append(opts, WithBaseDialer(d.BaseDialer))
+	}
+	dialer := newDirectOrHTTPConnUpgradeDialer(addr, d.KeepAlivePeriod, d.DialTimeout, d.Config, opts...)
 	conn, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -191,5 +517,5 @@ func (d *TLSRoutingDialer) DialContext(ctx context.Context, network, addr string
 		return nil, trace.Wrap(err)
 	}
 
-	return tlsConn, nil
+	return wrapWithIdleTimeout(tlsConn, d.IdleTimeout), nil
 }
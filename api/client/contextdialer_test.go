@@ -0,0 +1,236 @@
+/*
+Copyright 2024 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTunnelAddrCacheHitAndExpiry checks that a second get within the TTL
+// reuses the cached result without calling lookup again, and that a get
+// issued after the TTL has elapsed triggers a fresh lookup.
+func TestTunnelAddrCacheHitAndExpiry(t *testing.T) {
+	origTTL := tunnelAddrCacheTTL
+	tunnelAddrCacheTTL = 20 * time.Millisecond
+	t.Cleanup(func() { tunnelAddrCacheTTL = origTTL })
+
+	c := &tunnelAddrCache{entries: make(map[string]*tunnelAddrCacheEntry)}
+	var calls int32
+	lookup := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "tunnel.example.com:443", nil
+	}
+
+	addr, err := c.get(context.Background(), "proxy.example.com:443", lookup)
+	require.NoError(t, err)
+	require.Equal(t, "tunnel.example.com:443", addr)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	addr, err = c.get(context.Background(), "proxy.example.com:443", lookup)
+	require.NoError(t, err)
+	require.Equal(t, "tunnel.example.com:443", addr)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	require.Eventually(t, func() bool {
+		_, err := c.get(context.Background(), "proxy.example.com:443", lookup)
+		return err == nil && atomic.LoadInt32(&calls) == 2
+	}, time.Second, 5*time.Millisecond)
+}
+
+// TestTunnelAddrCacheSingleFlight checks that concurrent gets for the same
+// key while a lookup is in flight all block on, and share the result of,
+// that single call.
+func TestTunnelAddrCacheSingleFlight(t *testing.T) {
+	c := &tunnelAddrCache{entries: make(map[string]*tunnelAddrCacheEntry)}
+	var calls int32
+	release := make(chan struct{})
+	lookup := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "tunnel.example.com:443", nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	results := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = c.get(context.Background(), "proxy.example.com:443", lookup)
+		}(i)
+	}
+
+	// Give every goroutine a chance to reach the cache before unblocking the
+	// single in-flight lookup.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	for i := 0; i < n; i++ {
+		require.NoError(t, errs[i])
+		require.Equal(t, "tunnel.example.com:443", results[i])
+	}
+}
+
+// TestTunnelAddrCacheNegativeResult checks that a failed lookup is cached
+// too, so a second get within the TTL returns the same error without
+// calling lookup again.
+func TestTunnelAddrCacheNegativeResult(t *testing.T) {
+	c := &tunnelAddrCache{entries: make(map[string]*tunnelAddrCacheEntry)}
+	var calls int32
+	wantErr := errors.New("proxy unreachable")
+	lookup := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "", wantErr
+	}
+
+	_, err := c.get(context.Background(), "proxy.example.com:443", lookup)
+	require.ErrorIs(t, err, wantErr)
+
+	_, err = c.get(context.Background(), "proxy.example.com:443", lookup)
+	require.ErrorIs(t, err, wantErr)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+// TestTunnelAddrCacheInvalidate checks that invalidate evicts a cached
+// entry, so the next get issues a fresh lookup regardless of the TTL.
+func TestTunnelAddrCacheInvalidate(t *testing.T) {
+	c := &tunnelAddrCache{entries: make(map[string]*tunnelAddrCacheEntry)}
+	var calls int32
+	lookup := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "tunnel.example.com:443", nil
+	}
+
+	_, err := c.get(context.Background(), "proxy.example.com:443", lookup)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	c.invalidate("proxy.example.com:443")
+
+	_, err = c.get(context.Background(), "proxy.example.com:443", lookup)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+// TestIdleTimeoutConnClosesWhenIdle checks that a conn wrapped with a short
+// idle timeout is closed once no Read or Write happens within it, and that
+// I/O activity before then keeps resetting the clock. net.Pipe conns don't
+// implement real read/write deadlines, so this also exercises that the
+// timer-based enforcement doesn't depend on that support.
+func TestIdleTimeoutConnClosesWhenIdle(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	wrapped := wrapWithIdleTimeout(client, 30*time.Millisecond)
+
+	// Activity within the timeout should keep the conn alive.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Write([]byte("a"))
+	}()
+	buf := make([]byte, 1)
+	_, err := wrapped.Read(buf)
+	require.NoError(t, err)
+	<-done
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		server.Read(make([]byte, 1))
+	}()
+	_, err = wrapped.Write([]byte("b"))
+	require.NoError(t, err)
+	<-readDone
+
+	// Once I/O stops, the conn should be closed by the idle timer.
+	require.Eventually(t, func() bool {
+		_, err := wrapped.Write([]byte("c"))
+		return err != nil
+	}, time.Second, 5*time.Millisecond)
+}
+
+// TestHTTPConnect checks that httpConnect succeeds against a 200 response
+// and surfaces both non-200 responses and getAuth errors as errors. This
+// exercises newHTTPConnectTunnelDialer's CONNECT-tunnel handshake, which
+// otherwise has no caller or test in this tree.
+func TestHTTPConnect(t *testing.T) {
+	tests := []struct {
+		desc       string
+		response   string
+		getAuth    httpConnectAuthFunc
+		requireErr require.ErrorAssertionFunc
+	}{
+		{
+			desc:       "200 succeeds",
+			response:   "HTTP/1.1 200 Connection Established\r\n\r\n",
+			getAuth:    func(ctx context.Context) (string, error) { return "token", nil },
+			requireErr: require.NoError,
+		},
+		{
+			desc:       "non-200 fails",
+			response:   "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n",
+			getAuth:    func(ctx context.Context) (string, error) { return "token", nil },
+			requireErr: require.Error,
+		},
+		{
+			desc:       "getAuth error is propagated",
+			getAuth:    func(ctx context.Context) (string, error) { return "", errors.New("no token") },
+			requireErr: require.Error,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			serverDone := make(chan struct{})
+			go func() {
+				defer close(serverDone)
+				if test.response == "" {
+					return
+				}
+				req, err := http.ReadRequest(bufio.NewReader(server))
+				if err != nil {
+					return
+				}
+				require.Equal(t, http.MethodConnect, req.Method)
+				server.Write([]byte(test.response))
+			}()
+
+			err := httpConnect(context.Background(), client, "auth.example.com:0", test.getAuth)
+			test.requireErr(t, err)
+			<-serverDone
+		})
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// Wildcard is used as a key in maps (for example AppAWS.ExternalIDMap) to
+// mean "match anything that isn't more specifically matched".
+const Wildcard = "*"
+
+// appNameRegexp matches the same app-name grammar Teleport 14 enforces for
+// Database and Kube cluster names: starts with a letter, contains only
+// letters/digits/hyphens, and does not end with a hyphen.
+var appNameRegexp = regexp.MustCompile(`^[a-zA-Z]([-a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+
+// ValidateAppName validates an application resource name against the same
+// grammar used for Database and Kube cluster names, so that auto-discovered
+// apps don't break downstream routing.
+func ValidateAppName(name string) error {
+	if !appNameRegexp.MatchString(name) {
+		return trace.BadParameter("application name %q must start with a letter and contain only letters, digits, and hyphens, with no trailing hyphen", name)
+	}
+	return nil
+}
+
+// reservedKubeLabel is the DNS label reserved for the Kubernetes Access
+// proxy; no application's public address may use it as its leftmost label.
+const reservedKubeLabel = "kube"
+
+// maxDNSLabelLen is the maximum length of a single DNS label, per RFC 1035.
+const maxDNSLabelLen = 63
+
+// dnsLabelRegexp matches a single valid DNS label: letters, digits, and
+// internal hyphens, with neither a leading nor a trailing hyphen.
+var dnsLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// ValidateAppPublicAddr validates that an application's public address host
+// is a well-formed DNS name (each label matches dnsLabelRegexp and is no
+// longer than maxDNSLabelLen) and that it is not a subdomain of the "kube."
+// label reserved for the Kubernetes Access proxy.
+func ValidateAppPublicAddr(publicAddr string) error {
+	if publicAddr == "" {
+		return nil
+	}
+
+	addr := publicAddr
+	if idx := strings.Index(addr, "://"); idx != -1 {
+		addr = addr[idx+len("://"):]
+	}
+
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if len(label) > maxDNSLabelLen {
+			return trace.BadParameter("public_addr %q label %q exceeds the maximum DNS label length of %v", publicAddr, label, maxDNSLabelLen)
+		}
+		if !dnsLabelRegexp.MatchString(label) {
+			return trace.BadParameter("public_addr %q label %q is not a valid DNS label", publicAddr, label)
+		}
+	}
+
+	if labels[0] == reservedKubeLabel {
+		return trace.BadParameter("public_addr %q can not start with reserved word %q, which is used for Kubernetes Access", publicAddr, reservedKubeLabel)
+	}
+
+	return nil
+}
+
+// MetadataProtection is the EC2 instance metadata service (IMDS) protection
+// mode applied to a proxied AWS application, analogous to kube2iam's
+// --metadata-protection flag.
+type MetadataProtection string
+
+const (
+	// MetadataProtectionOff disables IMDS protection; requests to
+	// 169.254.169.254 are proxied through unmodified.
+	MetadataProtectionOff MetadataProtection = "off"
+	// MetadataProtectionRequireSDKUA blocks IMDS requests whose User-Agent
+	// does not match a known AWS SDK pattern.
+	MetadataProtectionRequireSDKUA MetadataProtection = "require-sdk-ua"
+	// MetadataProtectionRequireIMDSv2 blocks IMDS requests that do not
+	// carry a valid IMDSv2 session token.
+	MetadataProtectionRequireIMDSv2 MetadataProtection = "require-imdsv2"
+)
+
+// AppAWS contains additional options for AWS applications.
+type AppAWS struct {
+	// AssumeRoleARN is the AWS IAM role this app should assume when it is
+	// discovered by an app_service resource matcher, letting a single
+	// app_service proxy AWS consoles across multiple accounts.
+	AssumeRoleARN string `json:"assume_role_arn,omitempty"`
+	// ExternalID is the external ID Teleport should supply when assuming
+	// AssumeRoleARN. It may only be set together with AssumeRoleARN.
+	ExternalID string `json:"external_id,omitempty"`
+	// ExternalIDMap maps an AWS IAM role ARN to the external ID Teleport
+	// should supply when the app assumes that role. The Wildcard key
+	// supplies a default used when no role-specific entry matches.
+	ExternalIDMap map[string]string `json:"external_id_map,omitempty"`
+	// MetadataProtection controls how the app proxy handles outbound
+	// requests from the proxied workload to the EC2 IMDS endpoint. It
+	// defaults to MetadataProtectionOff.
+	MetadataProtection MetadataProtection `json:"metadata_protection,omitempty"`
+}
+
+// CheckAndSetDefaults checks validity of the AWS app options.
+func (a *AppAWS) CheckAndSetDefaults() error {
+	if a.ExternalID != "" && a.AssumeRoleARN == "" {
+		return trace.BadParameter("external_id requires assume_role_arn to be set")
+	}
+	if a.MetadataProtection == "" {
+		a.MetadataProtection = MetadataProtectionOff
+	}
+	switch a.MetadataProtection {
+	case MetadataProtectionOff, MetadataProtectionRequireSDKUA, MetadataProtectionRequireIMDSv2:
+	default:
+		return trace.BadParameter("metadata_protection %q is not one of %q, %q, %q", a.MetadataProtection,
+			MetadataProtectionOff, MetadataProtectionRequireSDKUA, MetadataProtectionRequireIMDSv2)
+	}
+	return nil
+}
+
+// AppSpecV3 is the AppV3 resource spec.
+type AppSpecV3 struct {
+	// URI is the application connection endpoint.
+	URI string `json:"uri"`
+	// PublicAddr is the public address the application is accessible at.
+	PublicAddr string `json:"public_addr,omitempty"`
+	// AWS contains additional options for AWS applications.
+	AWS *AppAWS `json:"aws,omitempty"`
+}
+
+// AppV3 represents an application access application.
+type AppV3 struct {
+	Metadata
+	// Spec is the application spec.
+	Spec AppSpecV3 `json:"spec"`
+}
+
+// NewAppV3 creates a new app resource.
+func NewAppV3(meta Metadata, spec AppSpecV3) (*AppV3, error) {
+	app := &AppV3{
+		Metadata: meta,
+		Spec:     spec,
+	}
+	if err := app.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return app, nil
+}
+
+// CheckAndSetDefaults checks and sets default values for the application.
+func (a *AppV3) CheckAndSetDefaults() error {
+	if err := a.Metadata.CheckAndSetDefaults(); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := ValidateAppName(a.Metadata.Name); err != nil {
+		return trace.Wrap(err)
+	}
+	if a.Spec.URI == "" {
+		return trace.BadParameter("application %q URI is empty", a.GetName())
+	}
+	if err := ValidateAppPublicAddr(a.Spec.PublicAddr); err != nil {
+		return trace.Wrap(err)
+	}
+	if a.Spec.AWS != nil {
+		if err := a.Spec.AWS.CheckAndSetDefaults(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// GetPublicAddr returns the application public address.
+func (a *AppV3) GetPublicAddr() string {
+	return a.Spec.PublicAddr
+}
+
+// GetURI returns the application connection endpoint.
+func (a *AppV3) GetURI() string {
+	return a.Spec.URI
+}
+
+// GetAWSExternalID returns the AWS external ID that should be used when
+// assuming roleARN. It prefers the matcher-scoped AssumeRoleARN/ExternalID
+// pair when roleARN is the role the app itself is configured to assume,
+// then falls back to an entry specific to roleARN, and finally to the
+// wildcard entry.
+func (a *AppV3) GetAWSExternalID(roleARN string) string {
+	if a.Spec.AWS == nil {
+		return ""
+	}
+	if a.Spec.AWS.AssumeRoleARN != "" && a.Spec.AWS.AssumeRoleARN == roleARN && a.Spec.AWS.ExternalID != "" {
+		return a.Spec.AWS.ExternalID
+	}
+	if id, ok := a.Spec.AWS.ExternalIDMap[roleARN]; ok {
+		return id
+	}
+	return a.Spec.AWS.ExternalIDMap[Wildcard]
+}
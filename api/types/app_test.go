@@ -18,6 +18,7 @@ package types
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/gravitational/teleport/api/constants"
@@ -43,6 +44,7 @@ func TestAppPublicAddrValidation(t *testing.T) {
 
 	tests := []struct {
 		name       string
+		appName    string
 		publicAddr string
 		check      check
 	}{
@@ -76,12 +78,44 @@ func TestAppPublicAddrValidation(t *testing.T) {
 			publicAddr: "https://kube.example.com:3080",
 			check:      hasErrTypeBadParameter(),
 		},
+		{
+			name:       "public address with overly long label",
+			publicAddr: strings.Repeat("a", maxDNSLabelLen+1) + ".example.com:3080",
+			check:      hasErrTypeBadParameter(),
+		},
+		{
+			name:       "public address with trailing hyphen label",
+			publicAddr: "app-.example.com:3080",
+			check:      hasErrTypeBadParameter(),
+		},
+		{
+			name:       "uppercase app name",
+			appName:    "TESTAPP",
+			publicAddr: "kubernetes.example.com:3080",
+			check:      hasNoErr(),
+		},
+		{
+			name:       "numeric-only app name",
+			appName:    "12345",
+			publicAddr: "kubernetes.example.com:3080",
+			check:      hasErrTypeBadParameter(),
+		},
+		{
+			name:       "app name with trailing hyphen",
+			appName:    "test-app-",
+			publicAddr: "kubernetes.example.com:3080",
+			check:      hasErrTypeBadParameter(),
+		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
+			appName := tc.appName
+			if appName == "" {
+				appName = "TestApp"
+			}
 			_, err := NewAppV3(Metadata{
-				Name: "TestApp",
+				Name: appName,
 			}, AppSpecV3{
 				PublicAddr: tc.publicAddr,
 				URI:        "localhost:3080",
@@ -224,3 +258,129 @@ func TestApplicationGetAWSExternalID(t *testing.T) {
 		})
 	}
 }
+
+// TestApplicationGetAWSExternalIDAssumeRole tests the interaction between
+// the matcher-scoped AssumeRoleARN/ExternalID pair and the legacy
+// ExternalIDMap when resolving the external ID for a given assumed role.
+func TestApplicationGetAWSExternalIDAssumeRole(t *testing.T) {
+	matcherRoleARN := "arn:aws:iam::1234567890:role/matcher-role"
+	otherRoleARN := "arn:aws:iam::1234567890:role/other-role"
+
+	tests := []struct {
+		name               string
+		appAWS             *AppAWS
+		queryRoleARN       string
+		expectedExternalID string
+	}{
+		{
+			name: "matcher role override",
+			appAWS: &AppAWS{
+				AssumeRoleARN: matcherRoleARN,
+				ExternalID:    "matcher-external-id",
+			},
+			queryRoleARN:       matcherRoleARN,
+			expectedExternalID: "matcher-external-id",
+		},
+		{
+			name: "fallback to wildcard when assumed role differs",
+			appAWS: &AppAWS{
+				AssumeRoleARN: matcherRoleARN,
+				ExternalID:    "matcher-external-id",
+				ExternalIDMap: map[string]string{
+					Wildcard: "default-external-id",
+				},
+			},
+			queryRoleARN:       otherRoleARN,
+			expectedExternalID: "default-external-id",
+		},
+		{
+			name: "assume-role chain prefers map entry for the assumed role",
+			appAWS: &AppAWS{
+				AssumeRoleARN: matcherRoleARN,
+				ExternalID:    "matcher-external-id",
+				ExternalIDMap: map[string]string{
+					otherRoleARN: "chained-external-id",
+				},
+			},
+			queryRoleARN:       otherRoleARN,
+			expectedExternalID: "chained-external-id",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			app, err := NewAppV3(Metadata{
+				Name: "aws",
+			}, AppSpecV3{
+				URI: constants.AWSConsoleURL,
+				AWS: test.appAWS,
+			})
+			require.NoError(t, err)
+
+			require.Equal(t, test.expectedExternalID, app.GetAWSExternalID(test.queryRoleARN))
+		})
+	}
+}
+
+// TestAppAWSCheckAndSetDefaults tests validation of the AppAWS spec.
+func TestAppAWSCheckAndSetDefaults(t *testing.T) {
+	tests := []struct {
+		name      string
+		appAWS    *AppAWS
+		assertErr require.ErrorAssertionFunc
+	}{
+		{
+			name:      "no assume role, no external ID",
+			appAWS:    &AppAWS{},
+			assertErr: require.NoError,
+		},
+		{
+			name: "assume role with external ID",
+			appAWS: &AppAWS{
+				AssumeRoleARN: "arn:aws:iam::1234567890:role/test-role",
+				ExternalID:    "external-id",
+			},
+			assertErr: require.NoError,
+		},
+		{
+			name: "external ID without assume role",
+			appAWS: &AppAWS{
+				ExternalID: "external-id",
+			},
+			assertErr: require.Error,
+		},
+		{
+			name: "valid metadata protection mode",
+			appAWS: &AppAWS{
+				MetadataProtection: MetadataProtectionRequireIMDSv2,
+			},
+			assertErr: require.NoError,
+		},
+		{
+			name: "invalid metadata protection mode",
+			appAWS: &AppAWS{
+				MetadataProtection: "blocked",
+			},
+			assertErr: require.Error,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			test.assertErr(t, test.appAWS.CheckAndSetDefaults())
+		})
+	}
+}
+
+// TestAppAWSMetadataProtectionDefault tests that MetadataProtection defaults
+// to MetadataProtectionOff when unset.
+func TestAppAWSMetadataProtectionDefault(t *testing.T) {
+	appAWS := &AppAWS{}
+	require.NoError(t, appAWS.CheckAndSetDefaults())
+	require.Equal(t, MetadataProtectionOff, appAWS.MetadataProtection)
+}
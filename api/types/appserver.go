@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"github.com/gravitational/trace"
+)
+
+// AppServerSpecV3 is the AppServerV3 resource spec.
+type AppServerSpecV3 struct {
+	// HostID is the ID of the host this app is running on.
+	HostID string `json:"host_id"`
+	// App is the app proxied by this app server.
+	App *AppV3 `json:"app"`
+}
+
+// AppServer represents a single proxied application.
+type AppServer interface {
+	Resource
+	// GetHostID returns the ID of the host this app server runs on.
+	GetHostID() string
+	// GetApp returns the app proxied by this app server.
+	GetApp() *AppV3
+}
+
+// AppServerV3 implements AppServer.
+type AppServerV3 struct {
+	Metadata
+	// Spec is the app server spec.
+	Spec AppServerSpecV3 `json:"spec"`
+}
+
+// NewAppServerV3 creates a new app server resource.
+func NewAppServerV3(meta Metadata, spec AppServerSpecV3) (*AppServerV3, error) {
+	s := &AppServerV3{
+		Metadata: meta,
+		Spec:     spec,
+	}
+	if err := s.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return s, nil
+}
+
+// CheckAndSetDefaults checks and sets default values for the app server.
+func (s *AppServerV3) CheckAndSetDefaults() error {
+	if err := s.Metadata.CheckAndSetDefaults(); err != nil {
+		return trace.Wrap(err)
+	}
+	if s.Spec.HostID == "" {
+		return trace.BadParameter("missing parameter HostID")
+	}
+	if s.Spec.App == nil {
+		return trace.BadParameter("missing parameter App")
+	}
+	return nil
+}
+
+// GetHostID returns the ID of the host this app server runs on.
+func (s *AppServerV3) GetHostID() string {
+	return s.Spec.HostID
+}
+
+// GetApp returns the app proxied by this app server.
+func (s *AppServerV3) GetApp() *AppV3 {
+	return s.Spec.App
+}
+
+// AppServers represents a list of app servers.
+type AppServers []AppServer
+
+// appServerFieldAccessors registers the fields AppServers can be sorted and
+// read by, driving SortByCustom/GetFieldVals through the generic
+// SortableResources engine.
+func appServerFieldAccessors() map[string]FieldAccessor[AppServer] {
+	return map[string]FieldAccessor[AppServer]{
+		ResourceMetadataName:    func(s AppServer) string { return s.GetApp().GetName() },
+		ResourceSpecDescription: func(s AppServer) string { return s.GetApp().Description },
+		ResourceSpecPublicAddr:  func(s AppServer) string { return s.GetApp().GetPublicAddr() },
+	}
+}
+
+// SortByCustom sorts by given sort criteria.
+func (s AppServers) SortByCustom(sortBy SortBy) error {
+	return trace.Wrap(NewSortableResources[AppServer](s, appServerFieldAccessors()).SortByCustom(sortBy))
+}
+
+// SortByMulti sorts by each SortBy in turn, for stable multi-key ordering.
+func (s AppServers) SortByMulti(sortBys []SortBy) error {
+	return trace.Wrap(NewSortableResources[AppServer](s, appServerFieldAccessors()).SortByMulti(sortBys))
+}
+
+// GetFieldVals returns the value of field for each app server, in the
+// slice's current order.
+func (s AppServers) GetFieldVals(field string) ([]string, error) {
+	return NewSortableResources[AppServer](s, appServerFieldAccessors()).GetFieldVals(field)
+}
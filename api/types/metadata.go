@@ -0,0 +1,93 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravitational/trace"
+)
+
+// defaultNamespace is the namespace resources are placed in when none is
+// specified.
+const defaultNamespace = "default"
+
+// Metadata is resource metadata shared by every resource kind in this
+// package.
+type Metadata struct {
+	// Name is the resource name.
+	Name string `json:"name"`
+	// Namespace is the resource namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// Description is an optional free-form description of the resource.
+	Description string `json:"description,omitempty"`
+	// Labels is a map of static labels attached to the resource.
+	Labels map[string]string `json:"labels,omitempty"`
+	// UID is a time-ordered UUIDv7 identifying this specific resource,
+	// distinct from Name. It is assigned on creation and left
+	// unchanged on update. Resources created before UID was introduced may
+	// have it empty.
+	UID string `json:"uid,omitempty"`
+}
+
+// GetName returns the resource name.
+func (m *Metadata) GetName() string {
+	return m.Name
+}
+
+// SetName sets the resource name.
+func (m *Metadata) SetName(name string) {
+	m.Name = name
+}
+
+// GetMetadata returns the resource metadata.
+func (m *Metadata) GetMetadata() Metadata {
+	return *m
+}
+
+// CheckAndSetDefaults checks validity of all parameters and sets defaults.
+func (m *Metadata) CheckAndSetDefaults() error {
+	if m.Name == "" {
+		return trace.BadParameter("missing parameter Name")
+	}
+	if m.Namespace == "" {
+		m.Namespace = defaultNamespace
+	}
+	if m.UID == "" {
+		id, err := uuid.NewV7()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		m.UID = id.String()
+	}
+	return nil
+}
+
+// GetCreationTimeFromUID extracts the creation time encoded in the resource's
+// UUIDv7 UID. It returns false if UID is empty or is not a valid UUIDv7.
+func (m *Metadata) GetCreationTimeFromUID() (time.Time, bool) {
+	if m.UID == "" {
+		return time.Time{}, false
+	}
+	id, err := uuid.Parse(m.UID)
+	if err != nil || id.Version() != 7 {
+		return time.Time{}, false
+	}
+	sec, nsec := id.Time().UnixTime()
+	return time.Unix(sec, nsec), true
+}
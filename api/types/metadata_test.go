@@ -0,0 +1,65 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetadataUIDAssignment checks that CheckAndSetDefaults assigns a UID to
+// a new resource and leaves an existing one untouched.
+func TestMetadataUIDAssignment(t *testing.T) {
+	m := &Metadata{Name: "test"}
+	require.NoError(t, m.CheckAndSetDefaults())
+	require.NotEmpty(t, m.UID)
+
+	existing := m.UID
+	require.NoError(t, m.CheckAndSetDefaults())
+	require.Equal(t, existing, m.UID, "UID must be preserved across updates")
+}
+
+// TestMetadataGetCreationTimeFromUID checks that the creation time can be
+// recovered from a UID, and that it's not available for resources created
+// before UID was introduced.
+func TestMetadataGetCreationTimeFromUID(t *testing.T) {
+	m := &Metadata{Name: "test"}
+	require.NoError(t, m.CheckAndSetDefaults())
+
+	created, ok := m.GetCreationTimeFromUID()
+	require.True(t, ok)
+	require.WithinDuration(t, created, time.Now(), time.Minute)
+
+	noUID := &Metadata{Name: "legacy"}
+	_, ok = noUID.GetCreationTimeFromUID()
+	require.False(t, ok)
+}
+
+// TestMetadataUIDMonotonic checks that UIDs generated for resources created
+// in quick succession sort in creation order, which is the whole point of
+// using time-ordered UUIDv7 identifiers.
+func TestMetadataUIDMonotonic(t *testing.T) {
+	uids := make([]string, 10)
+	for i := range uids {
+		m := &Metadata{Name: "test"}
+		require.NoError(t, m.CheckAndSetDefaults())
+		uids[i] = m.UID
+	}
+	require.IsIncreasing(t, uids)
+}
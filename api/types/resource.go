@@ -0,0 +1,44 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package types contains the resource types exchanged between Teleport
+// components.
+package types
+
+// Field names recognized by the SortByCustom/GetFieldVals implementations
+// of the various resource list kinds (AppServers, and friends).
+const (
+	ResourceMetadataName    = "name"
+	ResourceSpecDescription = "description"
+	ResourceSpecPublicAddr  = "publicAddr"
+)
+
+// SortBy describes how a list of resources should be sorted.
+type SortBy struct {
+	// Field is the resource field to sort by, one of the Resource* field
+	// name constants.
+	Field string
+	// IsDesc sorts in descending order when true, ascending otherwise.
+	IsDesc bool
+}
+
+// Resource is the common interface implemented by every resource kind.
+type Resource interface {
+	// GetName returns the resource name.
+	GetName() string
+	// SetName sets the resource name.
+	SetName(name string)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/require"
+)
+
+func buildAppServers(names, descriptions []string) ([]AppServer, error) {
+	servers := make([]AppServer, len(names))
+	for i := range names {
+		server, err := NewAppServerV3(Metadata{
+			Name: "_",
+		}, AppServerSpecV3{
+			HostID: "_",
+			App: &AppV3{
+				Metadata: Metadata{
+					Name:        names[i],
+					Description: descriptions[i],
+				},
+				Spec: AppSpecV3{
+					URI: "_",
+				},
+			},
+		})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		servers[i] = server
+	}
+	return servers, nil
+}
+
+func makeSortableAppServers(t *testing.T, names, descriptions []string) []AppServer {
+	t.Helper()
+	require.Equal(t, len(names), len(descriptions))
+
+	servers, err := buildAppServers(names, descriptions)
+	require.NoError(t, err)
+	return servers
+}
+
+// TestSortableResourcesNotImplemented checks that the generic engine
+// reports an unsupported field the same way the old hand-rolled switch
+// statements did.
+func TestSortableResourcesNotImplemented(t *testing.T) {
+	servers := AppServers(makeSortableAppServers(t, []string{"b", "a"}, []string{"y", "x"}))
+
+	err := servers.SortByCustom(SortBy{Field: "unsupported"})
+	require.True(t, trace.IsNotImplemented(err))
+
+	_, err = servers.GetFieldVals("unsupported")
+	require.True(t, trace.IsNotImplemented(err))
+}
+
+// TestAppServersSortByMulti checks that sorting by description then name
+// uses the name as a tiebreaker among servers that share a description.
+func TestAppServersSortByMulti(t *testing.T) {
+	servers := AppServers(makeSortableAppServers(t,
+		[]string{"b", "a", "c"},
+		[]string{"alpha", "alpha", "zulu"},
+	))
+
+	require.NoError(t, servers.SortByMulti([]SortBy{
+		{Field: ResourceSpecDescription},
+		{Field: ResourceMetadataName},
+	}))
+
+	names, err := servers.GetFieldVals(ResourceMetadataName)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, names)
+}
+
+func BenchmarkAppServersSortByCustomGeneric(b *testing.B) {
+	names := make([]string, 1000)
+	descriptions := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("app-%d", len(names)-i)
+		descriptions[i] = names[i]
+	}
+	rawServers, err := buildAppServers(names, descriptions)
+	require.NoError(b, err)
+	servers := AppServers(rawServers)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, servers.SortByCustom(SortBy{Field: ResourceMetadataName}))
+	}
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import "github.com/google/uuid"
+
+// getTestVal returns testVal when isTestField is true, and a random, unique
+// value otherwise -- used by sorter tests to only vary the field under
+// test while keeping the other fields distinct (and thus not accidentally
+// equal, which would make the sort order ambiguous).
+func getTestVal(isTestField bool, testVal string) string {
+	if isTestField {
+		return testVal
+	}
+	return uuid.NewString()
+}
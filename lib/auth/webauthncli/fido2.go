@@ -0,0 +1,857 @@
+//go:build libfido2
+// +build libfido2
+
+// Copyright 2022 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webauthncli implements the client side of WebAuthn ceremonies,
+// backed by libfido2 for FIDO2/CTAP2 (and, transparently, CTAP1/U2F)
+// authenticators.
+package webauthncli
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/keys-pub/go-libfido2"
+	"github.com/sirupsen/logrus"
+
+	"github.com/gravitational/teleport/api/client/proto"
+	wanpb "github.com/gravitational/teleport/api/types/webauthn"
+	wanlib "github.com/gravitational/teleport/lib/auth/webauthn"
+)
+
+// FIDO2PollInterval is the interval between polls for newly plugged-in
+// FIDO2/U2F devices.
+var FIDO2PollInterval = 200 * time.Millisecond
+
+// FIDODeviceLocations points to libfido2.DeviceLocations.
+// Replaced in tests.
+var FIDODeviceLocations = libfido2.DeviceLocations
+
+// FIDONewDevice points to a constructor equivalent to libfido2.NewDevice.
+// Replaced in tests.
+var FIDONewDevice = func(path string) (FIDODevice, error) {
+	return libfido2.NewDevice(path)
+}
+
+// FIDODevice abstracts *libfido2.Device, so it may be faked in tests.
+type FIDODevice interface {
+	Info() (*libfido2.DeviceInfo, error)
+	Cancel() error
+	MakeCredential(
+		clientDataHash []byte,
+		rp libfido2.RelyingParty,
+		user libfido2.User,
+		typ libfido2.CredentialType,
+		pin string,
+		opts *libfido2.MakeCredentialOpts,
+	) (*libfido2.Attestation, error)
+	Assertion(
+		rpID string,
+		clientDataHash []byte,
+		credentialIDs [][]byte,
+		pin string,
+		opts *libfido2.AssertionOpts,
+	) ([]*libfido2.Assertion, error)
+}
+
+// CredentialInfo describes a resident credential found on an authenticator,
+// surfaced to the user so they may choose amongst multiple accounts during a
+// passwordless login.
+type CredentialInfo struct {
+	RP           libfido2.RelyingParty
+	User         libfido2.User
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// LoginPrompt is the user interface for FIDO2Login.
+type LoginPrompt interface {
+	PromptPIN() (string, error)
+	PromptTouch() error
+	// PromptCredential prompts the user to choose a credential, in case more
+	// than one is available for a passwordless login.
+	PromptCredential(creds []*CredentialInfo) (*CredentialInfo, error)
+}
+
+// RegisterPrompt is the user interface for FIDO2Register.
+type RegisterPrompt interface {
+	PromptPIN() (string, error)
+	PromptTouch() error
+}
+
+// LoginOpts groups non-required options for FIDO2Login.
+type LoginOpts struct {
+	// User is the desired credential username, used to disambiguate
+	// passwordless logins when multiple resident credentials are present.
+	// If empty, the prompt's PromptCredential is used to pick one.
+	User string
+}
+
+// ErrUsingNonRegisteredDevice is returned by FIDO2Login when the only
+// devices found don't hold any of the allowed credentials.
+var ErrUsingNonRegisteredDevice = errors.New("FIDO2Login: using a non-registered device")
+
+// hmacSecretExtensionKey and prfExtensionKey are the WebAuthn client
+// extension identifiers recognized for CTAP2's hmac-secret extension: the
+// extension's own name, and the standardized "prf" wrapper clients may use
+// instead.
+const (
+	hmacSecretExtensionKey = "hmac-secret"
+	prfExtensionKey        = "prf"
+)
+
+// hmacSecretSalts holds the salt(s) requested for the hmac-secret/prf
+// extension during a login ceremony. Salt2, if present, asks the
+// authenticator to derive and return a second secret alongside the first.
+type hmacSecretSalts struct {
+	salt1 []byte
+	salt2 []byte
+}
+
+// hmacSecretSaltLen is the only salt length CTAP2's hmac-secret extension
+// accepts for a single evaluation; two candidate salts (salt1 and salt2,
+// concatenated) are requested by doubling up to hmacSecretSaltLen*2.
+const hmacSecretSaltLen = 32
+
+// hmacSecretSaltsFor extracts hmac-secret/prf salts from an assertion's
+// requested extensions, if present. It returns an error if a salt of the
+// wrong length was requested, rather than silently truncating or padding it.
+func hmacSecretSaltsFor(exts protocol.AuthenticationExtensions) (*hmacSecretSalts, error) {
+	if exts == nil {
+		return nil, nil
+	}
+	val, ok := exts[hmacSecretExtensionKey]
+	if !ok {
+		val, ok = exts[prfExtensionKey]
+	}
+	if !ok {
+		return nil, nil
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	salt1, _ := m["salt1"].([]byte)
+	if len(salt1) == 0 {
+		return nil, nil
+	}
+	if len(salt1) != hmacSecretSaltLen {
+		return nil, fmt.Errorf("hmac-secret salt1 must be %v bytes, got %v", hmacSecretSaltLen, len(salt1))
+	}
+	salt2, _ := m["salt2"].([]byte)
+	if len(salt2) > 0 && len(salt2) != hmacSecretSaltLen {
+		return nil, fmt.Errorf("hmac-secret salt2 must be %v bytes, got %v", hmacSecretSaltLen, len(salt2))
+	}
+	return &hmacSecretSalts{salt1: salt1, salt2: salt2}, nil
+}
+
+// hasFIDO2Extension reports whether a device advertises support for the
+// named CTAP2 extension in its getInfo response.
+func hasFIDO2Extension(info *libfido2.DeviceInfo, name string) bool {
+	if info == nil {
+		return false
+	}
+	for _, ext := range info.Extensions {
+		if ext == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFIDO2Version reports whether a device advertises the named CTAP
+// protocol version in its getInfo response.
+func hasFIDO2Version(info *libfido2.DeviceInfo, version string) bool {
+	if info == nil {
+		return false
+	}
+	for _, v := range info.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFIDO2Available returns true if FIDO2 login is available in this build.
+// It may be force-disabled via the TELEPORT_FIDO2 environment variable, used
+// mainly to let users fall back to U2F-only flows.
+func IsFIDO2Available() bool {
+	switch val := os.Getenv("TELEPORT_FIDO2"); val {
+	case "", "1":
+		return true
+	case "0":
+		return false
+	default:
+		logrus.Warnf("FIDO2: unexpected TELEPORT_FIDO2 value %q, defaulting to enabled", val)
+		return true
+	}
+}
+
+// fidoDeviceInfo groups a FIDODevice and its identifying path/info, used
+// while racing devices against each other.
+type fidoDeviceInfo struct {
+	path string
+	dev  FIDODevice
+	info *libfido2.DeviceInfo // nil for CTAP1-only devices.
+}
+
+func (d *fidoDeviceInfo) isFIDO2() bool {
+	return d.info != nil
+}
+
+func (d *fidoDeviceInfo) hasOption(name string) bool {
+	if d.info == nil {
+		return false
+	}
+	for _, opt := range d.info.Options {
+		if opt.Name == name {
+			return opt.Value == libfido2.True
+		}
+	}
+	return false
+}
+
+// isCTAP21 reports whether the device advertises CTAP2.1 support, required
+// for the native authenticatorSelection command used by FIDO2SelectDevice.
+func (d *fidoDeviceInfo) isCTAP21() bool {
+	return hasFIDO2Version(d.info, "FIDO_2_1")
+}
+
+// pollDevices polls FIDODeviceLocations every FIDO2PollInterval, invoking
+// onDevice for every device path not yet seen. Exits when ctx is done.
+func pollDevices(ctx context.Context, onDevice func(fidoDeviceInfo)) {
+	seen := make(map[string]bool)
+	ticker := time.NewTicker(FIDO2PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if locs, err := FIDODeviceLocations(); err == nil {
+			for _, loc := range locs {
+				if seen[loc.Path] {
+					continue
+				}
+				seen[loc.Path] = true
+
+				dev, err := FIDONewDevice(loc.Path)
+				if err != nil {
+					continue
+				}
+				info, _ := dev.Info() // CTAP1-only devices error here, that's fine.
+				onDevice(fidoDeviceInfo{path: loc.Path, dev: dev, info: info})
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// clientDataHash hashes the CollectedClientData for a ceremony, as expected
+// by libfido2's MakeCredential/Assertion calls.
+func clientDataHash(ceremony protocol.CeremonyType, origin string, challenge protocol.URLEncodedBase64) (ccdJSON, ccdHash []byte, err error) {
+	ccd := protocol.CollectedClientData{
+		Type:      protocol.CeremonyToString(ceremony),
+		Challenge: challenge.String(),
+		Origin:    origin,
+	}
+	ccdJSON, err = json.Marshal(ccd)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(ccdJSON)
+	return ccdJSON, sum[:], nil
+}
+
+// fido2PreflightMatch silently discovers whether dev holds any of allowedIDs
+// for rpID, issuing a CTAP2 GetAssertion with user presence disabled
+// (analogous to the Firefox authenticator crate's silently_discover_credentials).
+// It never requires a touch, so it's safe to call on every plugged-in device
+// before arming any of them for the real, UP=true request.
+func fido2PreflightMatch(dev fidoDeviceInfo, rpID string, ccdHash []byte, allowedIDs [][]byte) (matched bool, err error) {
+	_, err = dev.dev.Assertion(rpID, ccdHash, allowedIDs, "" /* pin */, &libfido2.AssertionOpts{UP: libfido2.False})
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, libfido2.ErrNoCredentials):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// nonInteractiveError wraps an authenticator error that was resolved without
+// requiring the user to touch the device, as opposed to an error surfaced
+// after a touch. CTAP1/U2F devices answer ErrNoCredentials this way: they
+// consult their credential store and reply instantly, so treating that reply
+// like a touched-but-rejected device would eat the user's next touch for no
+// reason.
+type nonInteractiveError struct {
+	err error
+}
+
+func (e *nonInteractiveError) Error() string { return e.err.Error() }
+func (e *nonInteractiveError) Unwrap() error { return e.err }
+
+// fido2Login runs the login ceremony. For MFA it races every plugged-in
+// device, returning as soon as one yields a usable assertion. For
+// passwordless it first picks a single device via FIDO2SelectDevice, since
+// letting every device attempt the real (UV-required) assertion would cost
+// the user one touch per device plugged in.
+func fido2Login(
+	ctx context.Context,
+	origin string, assertion *wanlib.CredentialAssertion, prompt LoginPrompt, opts *LoginOpts,
+) (*proto.MFAAuthenticateResponse, string, error) {
+	switch {
+	case origin == "":
+		return nil, "", errors.New("origin required")
+	case assertion == nil:
+		return nil, "", errors.New("assertion required")
+	case len(assertion.Response.Challenge) == 0:
+		return nil, "", errors.New("assertion challenge required")
+	case assertion.Response.RelyingPartyID == "":
+		return nil, "", errors.New("assertion relying party ID required")
+	case prompt == nil:
+		return nil, "", errors.New("prompt required")
+	}
+
+	rpID := assertion.Response.RelyingPartyID
+	passwordless := len(assertion.Response.AllowedCredentials) == 0
+
+	ccdJSON, ccdHash, err := clientDataHash(protocol.AssertCeremony, origin, assertion.Response.Challenge)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var appID string
+	if val, ok := assertion.Response.Extensions[wanlib.AppIDExtension]; ok {
+		appID, _ = val.(string)
+	}
+	hmacSalts, err := hmacSecretSaltsFor(assertion.Response.Extensions)
+	if err != nil {
+		return nil, "", err
+	}
+
+	allowedIDs := make([][]byte, len(assertion.Response.AllowedCredentials))
+	for i, cred := range assertion.Response.AllowedCredentials {
+		allowedIDs[i] = cred.CredentialID
+	}
+
+	// assertDevice runs the assertion ceremony against a single device,
+	// trying appID candidates in turn. A *nonInteractiveError means the
+	// device rejected the request instantly, without a touch.
+	assertDevice := func(dev fidoDeviceInfo) (assertions []*libfido2.Assertion, usedAppID bool, err error) {
+		for _, tryRPID := range appIDCandidates(rpID, appID) {
+			usedAppID = tryRPID == appID
+
+			pin := ""
+			if dev.isFIDO2() && dev.hasOption("clientPin") {
+				pin, err = prompt.PromptPIN()
+				if err != nil {
+					return nil, false, err
+				}
+			}
+
+			assertOpts := &libfido2.AssertionOpts{UP: libfido2.True}
+			if passwordless {
+				assertOpts.UV = libfido2.True
+			}
+			if hmacSalts != nil && hasFIDO2Extension(dev.info, libfido2.HMACSecretExtension) {
+				assertOpts.Extensions = libfido2.Extensions{libfido2.HMACSecretExtension}
+				assertOpts.HMACSalt = append(append([]byte{}, hmacSalts.salt1...), hmacSalts.salt2...)
+			}
+
+			assertions, err = dev.dev.Assertion(tryRPID, ccdHash, allowedIDs, pin, assertOpts)
+			if errors.Is(err, libfido2.ErrUnsupportedOption) && assertOpts.UV == libfido2.True {
+				// Some PIN authenticators don't accept a standalone UV request; a
+				// verified PIN already doubles as user verification for them.
+				assertOpts.UV = ""
+				assertions, err = dev.dev.Assertion(tryRPID, ccdHash, allowedIDs, pin, assertOpts)
+			}
+
+			switch {
+			case errors.Is(err, libfido2.ErrNoCredentials):
+				if !dev.isFIDO2() {
+					// CTAP1/U2F devices answer ErrNoCredentials instantly, without a
+					// touch. Mark the rejection as non-interactive so the caller can
+					// let it go quietly, instead of consuming the user's next touch.
+					return nil, false, &nonInteractiveError{err: err}
+				}
+				continue // try the next candidate RPID (e.g. the U2F AppID), if any.
+			case err != nil:
+				return nil, false, err
+			}
+
+			return assertions, usedAppID, nil
+		}
+
+		return nil, false, ErrUsingNonRegisteredDevice
+	}
+
+	type result struct {
+		dev        fidoDeviceInfo
+		assertions []*libfido2.Assertion
+		usedAppID  bool
+		err        error
+	}
+
+	var resp result
+	if passwordless {
+		// Passwordless logins must pick a single device before asserting:
+		// racing the real (UV-required) assertion across every plugged-in
+		// device, as the MFA path below does, would make each losing device
+		// consume a touch of its own. FIDO2SelectDevice arbitrates this via
+		// the native CTAP2.1 authenticatorSelection command where available,
+		// falling back to a touch-only probe for CTAP2.0 devices, and
+		// cancels every device that didn't win. This costs an extra touch
+		// up front, separate from the one the real assertion below requires.
+		if err := prompt.PromptTouch(); err != nil {
+			return nil, "", err
+		}
+		dev, info, err := FIDO2SelectDevice(ctx, prompt)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := prompt.PromptTouch(); err != nil {
+			return nil, "", err
+		}
+		assertions, usedAppID, err := assertDevice(fidoDeviceInfo{dev: dev, info: info})
+		if err != nil {
+			return nil, "", err
+		}
+		resp = result{assertions: assertions, usedAppID: usedAppID}
+	} else {
+		resultC := make(chan result)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		racers := make([]fidoDeviceInfo, 0)
+		armed := make(map[string]bool) // dev path -> waiting on the real request
+		pollCtx, cancelPoll := context.WithCancel(ctx)
+		defer cancelPoll()
+
+		// Preflight every currently plugged-in device with a touch-free
+		// (UP=false) GetAssertion, so only authenticators that actually hold
+		// one of the allowed credentials are ever armed for the real,
+		// UP=true request below. CTAP1/U2F devices already reject a
+		// non-matching key handle instantly (see assertDevice's
+		// ErrNoCredentials handling above), so they're exempted and always
+		// treated as candidates.
+		candidates := make(map[string]bool) // dev path -> worth a real touch
+		sawDevice := false
+		if locs, err := FIDODeviceLocations(); err == nil {
+			for _, loc := range locs {
+				dev, err := FIDONewDevice(loc.Path)
+				if err != nil {
+					continue
+				}
+				sawDevice = true
+				fdi := fidoDeviceInfo{path: loc.Path, dev: dev}
+				fdi.info, _ = dev.Info()
+
+				if !fdi.isFIDO2() {
+					candidates[fdi.path] = true
+					continue
+				}
+				matched, err := fido2PreflightMatch(fdi, rpID, ccdHash, allowedIDs)
+				if matched || err != nil {
+					// A device that errors out of the preflight itself is kept
+					// as a fallback candidate rather than silently dropped.
+					candidates[fdi.path] = true
+				} else {
+					logrus.Debugf("FIDO2Login: preflight found no allowed credentials on device %v, skipping", fdi.path)
+				}
+			}
+		}
+		if sawDevice && len(candidates) == 0 {
+			return nil, "", ErrUsingNonRegisteredDevice
+		}
+
+		handle := func(dev fidoDeviceInfo) {
+			defer wg.Done()
+
+			if !candidates[dev.path] && dev.isFIDO2() {
+				if matched, err := fido2PreflightMatch(dev, rpID, ccdHash, allowedIDs); err == nil && !matched {
+					logrus.Debugf("FIDO2Login: preflight found no allowed credentials on device %v, skipping", dev.path)
+					return
+				}
+			}
+
+			mu.Lock()
+			armed[dev.path] = true
+			mu.Unlock()
+			assertions, usedAppID, err := assertDevice(dev)
+
+			var nonInteractiveErr *nonInteractiveError
+			if errors.As(err, &nonInteractiveErr) {
+				// Let the goroutine exit quietly, so the outer loop keeps waiting
+				// on other devices instead of consuming the user's next touch.
+				logrus.Debugf("FIDO2Login: ignoring non-registered CTAP1 device: %v", nonInteractiveErr)
+				mu.Lock()
+				delete(armed, dev.path)
+				mu.Unlock()
+				return
+			}
+
+			select {
+			case resultC <- result{dev: dev, assertions: assertions, usedAppID: usedAppID, err: err}:
+			case <-pollCtx.Done(): // a winner was already picked
+			}
+		}
+
+		go pollDevices(pollCtx, func(dev fidoDeviceInfo) {
+			mu.Lock()
+			racers = append(racers, dev)
+			mu.Unlock()
+
+			wg.Add(1)
+			go handle(dev)
+		})
+
+	loop:
+		for {
+			select {
+			case resp = <-resultC:
+				if resp.err == nil {
+					break loop
+				}
+				// Keep waiting: other devices may still be racing.
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			}
+		}
+		cancelPoll()
+
+		// Cancel every other device still racing: Assertion(UP=true) ignores
+		// Go context, so without this a losing device that also holds a valid
+		// credential would block on a touch that never comes, and wg.Wait
+		// below would hang forever.
+		mu.Lock()
+		for _, dev := range racers {
+			if dev.path != resp.dev.path && armed[dev.path] {
+				_ = dev.dev.Cancel()
+			}
+		}
+		mu.Unlock()
+		wg.Wait()
+	}
+
+	chosen, user, err := pickAssertion(resp.assertions, opts, prompt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Copy the derived secret out before zeroing the assertion's copy: it's
+	// surfaced to the caller via the extension output below, but libfido2's
+	// own buffer has served its purpose and shouldn't linger in memory.
+	hmacSecret := append([]byte{}, chosen.HMACSecret...)
+	defer zero(chosen.HMACSecret)
+
+	return &proto.MFAAuthenticateResponse{
+		Response: &proto.MFAAuthenticateResponse_Webauthn{
+			Webauthn: &wanpb.CredentialAssertionResponse{
+				Type:  string(protocol.PublicKeyCredentialType),
+				RawId: chosen.CredentialID,
+				Response: &wanpb.AuthenticatorAssertionResponse{
+					ClientDataJson:    ccdJSON,
+					AuthenticatorData: chosen.AuthDataCBOR,
+					Signature:         chosen.Sig,
+					UserHandle:        chosen.User.ID,
+				},
+				Extensions: &wanpb.AuthenticationExtensionsClientOutputs{
+					AppId:         resp.usedAppID,
+					HmacGetSecret: hmacSecret,
+				},
+			},
+		},
+	}, user, nil
+}
+
+// zero overwrites b in place, for secrets that shouldn't linger in memory
+// longer than necessary.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// appIDCandidates returns the RPIDs to try an assertion against, in order:
+// the "real" RPID first, falling back to the legacy U2F AppID extension
+// (when present) for devices registered before FIDO2 support existed.
+func appIDCandidates(rpID, appID string) []string {
+	if appID == "" {
+		return []string{rpID}
+	}
+	return []string{rpID, appID}
+}
+
+// pickAssertion chooses the assertion to respond with, prompting the user to
+// disambiguate when the authenticator returned more than one resident
+// credential.
+func pickAssertion(assertions []*libfido2.Assertion, opts *LoginOpts, prompt LoginPrompt) (*libfido2.Assertion, string, error) {
+	switch len(assertions) {
+	case 0:
+		return nil, "", libfido2.ErrNoCredentials
+	case 1:
+		return assertions[0], assertions[0].User.Name, nil
+	}
+
+	wantUser := ""
+	if opts != nil {
+		wantUser = opts.User
+	}
+	if wantUser != "" {
+		for _, a := range assertions {
+			if a.User.Name == wantUser {
+				return a, wantUser, nil
+			}
+		}
+		return nil, "", fmt.Errorf("no credentials for user %q", wantUser)
+	}
+
+	creds := make([]*CredentialInfo, len(assertions))
+	for i, a := range assertions {
+		creds[i] = &CredentialInfo{
+			User:         a.User,
+			CredentialID: a.CredentialID,
+		}
+	}
+	chosen, err := prompt.PromptCredential(creds)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, a := range assertions {
+		if string(a.CredentialID) == string(chosen.CredentialID) {
+			return a, a.User.Name, nil
+		}
+	}
+	return nil, "", errors.New("chosen credential not found")
+}
+
+// fido2Register runs the registration ceremony against every plugged-in
+// device, returning as soon as one of them produces an attestation.
+func fido2Register(
+	ctx context.Context,
+	origin string, cc *wanlib.CredentialCreation, prompt RegisterPrompt,
+) (*proto.MFARegisterResponse, error) {
+	switch {
+	case origin == "":
+		return nil, errors.New("origin required")
+	case cc == nil:
+		return nil, errors.New("credential creation required")
+	case len(cc.Response.Challenge) == 0:
+		return nil, errors.New("cc challenge required")
+	case cc.Response.RelyingParty.ID == "":
+		return nil, errors.New("cc relying party ID required")
+	case prompt == nil:
+		return nil, errors.New("prompt required")
+	}
+	if !hasES256(cc.Response.Parameters) {
+		return nil, errors.New("ES256 not found in credential parameters")
+	}
+
+	rrk := cc.Response.AuthenticatorSelection.RequireResidentKey != nil &&
+		*cc.Response.AuthenticatorSelection.RequireResidentKey
+	if rrk {
+		switch {
+		case cc.Response.RelyingParty.Name == "":
+			return nil, errors.New("relying party name required for resident credentials")
+		case cc.Response.User.Name == "":
+			return nil, errors.New("user name required for resident credentials")
+		case cc.Response.User.DisplayName == "":
+			return nil, errors.New("user display name required for resident credentials")
+		case len(cc.Response.User.ID) == 0:
+			return nil, errors.New("user ID required for resident credentials")
+		}
+	}
+
+	ccdJSON, ccdHash, err := clientDataHash(protocol.CreateCeremony, origin, cc.Response.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	hmacSecretRequested := false
+	if val, ok := cc.Response.Extensions[hmacSecretExtensionKey]; ok {
+		hmacSecretRequested, _ = val.(bool)
+	}
+
+	rp := libfido2.RelyingParty{ID: cc.Response.RelyingParty.ID, Name: cc.Response.RelyingParty.Name}
+	user := libfido2.User{
+		ID:          cc.Response.User.ID,
+		Name:        cc.Response.User.Name,
+		DisplayName: cc.Response.User.DisplayName,
+	}
+
+	excludedIDs := make([][]byte, len(cc.Response.CredentialExcludeList))
+	for i, cred := range cc.Response.CredentialExcludeList {
+		excludedIDs[i] = cred.CredentialID
+	}
+
+	type result struct {
+		att               *libfido2.Attestation
+		hmacSecretEnabled bool
+		err               error
+	}
+	resultC := make(chan result)
+
+	var wg sync.WaitGroup
+	pollCtx, cancelPoll := context.WithCancel(ctx)
+	defer cancelPoll()
+
+	handle := func(dev fidoDeviceInfo) {
+		defer wg.Done()
+
+		pin := ""
+		if dev.isFIDO2() && dev.hasOption("clientPin") {
+			pin, err = prompt.PromptPIN()
+			if err != nil {
+				resultC <- result{err: err}
+				return
+			}
+		}
+
+		if len(excludedIDs) > 0 {
+			_, err := dev.dev.Assertion(rp.ID, ccdHash, excludedIDs, pin, &libfido2.AssertionOpts{UP: libfido2.False})
+			if err == nil {
+				resultC <- result{err: errors.New("excluded credential present on device")}
+				return
+			}
+		}
+
+		opts := &libfido2.MakeCredentialOpts{}
+		if rrk {
+			opts.RK = libfido2.True
+			opts.UV = libfido2.True
+		} else if cc.Response.AuthenticatorSelection.UserVerification == protocol.VerificationRequired {
+			opts.UV = libfido2.True
+		}
+		hmacSecretEnabled := hmacSecretRequested && hasFIDO2Extension(dev.info, libfido2.HMACSecretExtension)
+		if hmacSecretEnabled {
+			opts.Extensions = libfido2.Extensions{libfido2.HMACSecretExtension}
+		}
+
+		att, err := dev.dev.MakeCredential(ccdHash, rp, user, libfido2.ES256, pin, opts)
+		if err != nil {
+			resultC <- result{err: err}
+			return
+		}
+		resultC <- result{att: att, hmacSecretEnabled: hmacSecretEnabled}
+	}
+
+	go pollDevices(pollCtx, func(dev fidoDeviceInfo) {
+		wg.Add(1)
+		go handle(dev)
+	})
+
+	var resp result
+	for {
+		select {
+		case resp = <-resultC:
+			if resp.err == nil {
+				goto done
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+done:
+	cancelPoll()
+	wg.Wait()
+
+	attObjCBOR, err := cbor.Marshal(&protocol.AttestationObject{
+		RawAuthData:  resp.att.AuthData,
+		Format:       resp.att.Format,
+		AttStatement: attStatementFor(resp.att),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.MFARegisterResponse{
+		Response: &proto.MFARegisterResponse_Webauthn{
+			Webauthn: &wanpb.CredentialCreationResponse{
+				Type:  string(protocol.PublicKeyCredentialType),
+				RawId: resp.att.CredentialID,
+				Response: &wanpb.AuthenticatorAttestationResponse{
+					ClientDataJson:    ccdJSON,
+					AttestationObject: attObjCBOR,
+				},
+				Extensions: &wanpb.AuthenticationExtensionsClientOutputs{
+					HmacCreateSecret: resp.hmacSecretEnabled,
+				},
+			},
+		},
+	}, nil
+}
+
+func hasES256(params []protocol.CredentialParameter) bool {
+	for _, p := range params {
+		if p.Type == protocol.PublicKeyCredentialType && p.Algorithm == -7 { // ES256
+			return true
+		}
+	}
+	return false
+}
+
+// attStatementFor builds the CBOR attestation statement map for the format
+// reported by the authenticator. A "none" format carries no statement.
+func attStatementFor(att *libfido2.Attestation) map[string]interface{} {
+	if att.Format == "none" || len(att.Sig) == 0 {
+		return nil
+	}
+	stmt := map[string]interface{}{
+		"alg": int64(-7), // ES256
+		"sig": att.Sig,
+	}
+	if att.Cert != nil {
+		stmt["x5c"] = []interface{}{att.Cert}
+	}
+	return stmt
+}
+
+// FIDO2Login implements Login for CTAP1 and CTAP2 devices, via libfido2. It
+// blocks until one of the plugged-in devices satisfies the assertion, the
+// user cancels, or ctx is done.
+//
+// Returns the MFA authentication response, the name of the user associated
+// with the credential used (only known for passwordless logins with more
+// than one resident credential), and an error, if any.
+func FIDO2Login(
+	ctx context.Context,
+	origin string, assertion *wanlib.CredentialAssertion, prompt LoginPrompt, opts *LoginOpts,
+) (*proto.MFAAuthenticateResponse, string, error) {
+	return fido2Login(ctx, origin, assertion, prompt, opts)
+}
+
+// FIDO2Register implements Register for CTAP1 and CTAP2 devices, via
+// libfido2.
+func FIDO2Register(
+	ctx context.Context,
+	origin string, cc *wanlib.CredentialCreation, prompt RegisterPrompt,
+) (*proto.MFARegisterResponse, error) {
+	return fido2Register(ctx, origin, cc, prompt)
+}
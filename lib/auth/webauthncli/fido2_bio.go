@@ -0,0 +1,148 @@
+//go:build libfido2
+// +build libfido2
+
+// Copyright 2022 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webauthncli
+
+import (
+	"context"
+	"errors"
+
+	"github.com/keys-pub/go-libfido2"
+)
+
+// BioEnrollPrompt is the user interface for FIDO2BioEnrollment.
+// It reports the evolving state of a fingerprint enrollment so the caller
+// can show progress ("touch sensor N more times") to the user.
+type BioEnrollPrompt interface {
+	LoginPrompt
+
+	// PromptEnrollmentSample is called after each captured sample, with the
+	// number of samples still required to finish the enrollment.
+	PromptEnrollmentSample(remainingSamples int)
+}
+
+// BioEnrollmentInfo describes a single fingerprint template stored on an
+// authenticator.
+type BioEnrollmentInfo struct {
+	TemplateID   []byte
+	FriendlyName string
+}
+
+// fido2BioEnrollmentDevice is the device interface used by
+// FIDO2BioEnrollment: FIDODevice plus the bio enrollment methods, with
+// templates reported as this package's BioEnrollmentInfo.
+type fido2BioEnrollmentDevice interface {
+	FIDODevice
+	BioInfo() (*libfido2.BioInfo, error)
+	BioEnrollEnumerate(pin string) ([]*BioEnrollmentInfo, error)
+	BioEnroll(pin string) (templateID []byte, err error)
+	BioEnrollContinue(pin string, templateID []byte) (remainingSamples int, err error)
+	BioEnrollCancel() error
+	BioEnrollRemove(pin string, templateID []byte) error
+	BioEnrollName(pin string, templateID []byte, name string) error
+}
+
+// FIDO2BioEnrollment wraps CTAP2.1's authenticatorBioEnrollment command,
+// letting callers enumerate, add, rename and remove fingerprint templates on
+// bio-capable authenticators.
+type FIDO2BioEnrollment struct {
+	dev fido2BioEnrollmentDevice
+	pin string
+}
+
+// NewFIDO2BioEnrollment selects a device (reusing the same flow as
+// FIDO2Login) and starts a bio enrollment session against it, requiring the
+// authenticator's PIN up front.
+func NewFIDO2BioEnrollment(ctx context.Context, prompt BioEnrollPrompt) (*FIDO2BioEnrollment, error) {
+	if prompt == nil {
+		return nil, errors.New("prompt required")
+	}
+
+	dev, info, err := FIDO2SelectDevice(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	bioDev, ok := dev.(fido2BioEnrollmentDevice)
+	if !ok {
+		return nil, errors.New("selected device does not support bio enrollment")
+	}
+	if info == nil || !hasFIDO2Option(info, "bioEnroll") {
+		return nil, errors.New("selected device is not a biometric authenticator")
+	}
+
+	pin, err := prompt.PromptPIN()
+	if err != nil {
+		return nil, err
+	}
+	return &FIDO2BioEnrollment{dev: bioDev, pin: pin}, nil
+}
+
+// SensorInfo returns the authenticator's sensor capabilities: fingerprint
+// kind, maximum sample count and maximum friendly-name length.
+func (e *FIDO2BioEnrollment) SensorInfo() (*libfido2.BioInfo, error) {
+	return e.dev.BioInfo()
+}
+
+// EnumerateTemplates lists the fingerprint templates currently enrolled on
+// the device.
+func (e *FIDO2BioEnrollment) EnumerateTemplates() ([]*BioEnrollmentInfo, error) {
+	return e.dev.BioEnrollEnumerate(e.pin)
+}
+
+// EnrollBegin starts a new fingerprint enrollment, capturing the first
+// sample, and streams progress to prompt until the enrollment is complete or
+// canceled. The returned templateID may be used with SetTemplateName or
+// RemoveTemplate.
+func (e *FIDO2BioEnrollment) EnrollBegin(prompt BioEnrollPrompt) (templateID []byte, err error) {
+	templateID, err = e.dev.BioEnroll(e.pin)
+	if err != nil {
+		return nil, err
+	}
+	return templateID, e.captureRemaining(templateID, prompt)
+}
+
+// captureRemaining keeps calling BioEnrollContinue, reporting the remaining
+// sample count via prompt, until the authenticator reports the enrollment
+// complete (remainingSamples == 0) or an error occurs.
+func (e *FIDO2BioEnrollment) captureRemaining(templateID []byte, prompt BioEnrollPrompt) error {
+	for {
+		remaining, err := e.dev.BioEnrollContinue(e.pin, templateID)
+		if err != nil {
+			return err
+		}
+		prompt.PromptEnrollmentSample(remaining)
+		if remaining <= 0 {
+			return nil
+		}
+	}
+}
+
+// RemoveTemplate deletes a fingerprint template by ID.
+func (e *FIDO2BioEnrollment) RemoveTemplate(templateID []byte) error {
+	return e.dev.BioEnrollRemove(e.pin, templateID)
+}
+
+// SetTemplateName sets (or renames) the friendly name of a fingerprint
+// template.
+func (e *FIDO2BioEnrollment) SetTemplateName(templateID []byte, name string) error {
+	return e.dev.BioEnrollName(e.pin, templateID, name)
+}
+
+// Cancel aborts an in-progress enrollment.
+func (e *FIDO2BioEnrollment) Cancel() error {
+	return e.dev.BioEnrollCancel()
+}
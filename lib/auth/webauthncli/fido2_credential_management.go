@@ -0,0 +1,139 @@
+//go:build libfido2
+// +build libfido2
+
+// Copyright 2022 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webauthncli
+
+import (
+	"context"
+	"errors"
+
+	"github.com/keys-pub/go-libfido2"
+)
+
+// CredentialManagementOpts groups non-required options for
+// FIDO2CredentialManagement.
+type CredentialManagementOpts struct {
+	// CredentialID, if set, restricts the operation to a single resident
+	// credential.
+	CredentialID []byte
+	// NewUser, if set alongside CredentialID, updates the user information
+	// of the credential instead of deleting it.
+	NewUser *libfido2.User
+}
+
+// fido2CredentialManagementDevice is the libfido2.Device subset required by
+// FIDO2CredentialManagement. *libfido2.Device satisfies this interface
+// directly; FIDODevice is extended with the same methods for fakes.
+type fido2CredentialManagementDevice interface {
+	FIDODevice
+	CredentialsInfo(pin string) (*libfido2.CredentialsInfo, error)
+	EnumerateRPs(pin string) ([]*libfido2.RelyingParty, error)
+	EnumerateCredentials(pin string, rp *libfido2.RelyingParty) ([]*libfido2.Credential, error)
+	DeleteCredential(credID []byte, pin string) error
+	UpdateUserInfo(credID []byte, user libfido2.User, pin string) error
+}
+
+// FIDO2CredentialManagement lists (or deletes) the resident/discoverable
+// credentials stored on a FIDO2 authenticator, using CTAP2's
+// authenticatorCredentialManagement command.
+//
+// It selects a single device the same way FIDO2Login does (first touched
+// device wins), requires a PIN-capable (clientPin) authenticator and always
+// prompts for its PIN, then lists every RP
+// with resident credentials and, for each, every credential under it.
+//
+// Set opts.CredentialID to delete a specific credential instead of listing,
+// or opts.CredentialID plus opts.NewUser to update that credential's user
+// information instead.
+func FIDO2CredentialManagement(ctx context.Context, prompt LoginPrompt, opts *CredentialManagementOpts) ([]*CredentialInfo, error) {
+	if prompt == nil {
+		return nil, errors.New("prompt required")
+	}
+
+	dev, info, err := FIDO2SelectDevice(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	cmDev, ok := dev.(fido2CredentialManagementDevice)
+	if !ok {
+		return nil, errors.New("selected device does not support credential management")
+	}
+	if info == nil || !hasFIDO2Option(info, "clientPin") {
+		return nil, errors.New("credential management requires a PIN-capable authenticator")
+	}
+
+	pin, err := prompt.PromptPIN()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts != nil && len(opts.CredentialID) > 0 {
+		if opts.NewUser != nil {
+			return nil, cmDev.UpdateUserInfo(opts.CredentialID, *opts.NewUser, pin)
+		}
+		return nil, cmDev.DeleteCredential(opts.CredentialID, pin)
+	}
+
+	rps, err := cmDev.EnumerateRPs(pin)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []*CredentialInfo
+	for _, rp := range rps {
+		rpCreds, err := cmDev.EnumerateCredentials(pin, rp)
+		if err != nil {
+			return nil, err
+		}
+		for _, cred := range rpCreds {
+			creds = append(creds, &CredentialInfo{
+				RP:           *rp,
+				User:         cred.User,
+				CredentialID: cred.ID,
+				PublicKey:    cred.Public,
+			})
+		}
+	}
+	return creds, nil
+}
+
+// FIDO2DeleteCredential deletes a single resident credential, identified by
+// its credential ID, from the selected authenticator.
+func FIDO2DeleteCredential(ctx context.Context, credID []byte, prompt LoginPrompt) error {
+	_, err := FIDO2CredentialManagement(ctx, prompt, &CredentialManagementOpts{CredentialID: credID})
+	return err
+}
+
+// FIDO2UpdateCredentialUser updates the user information (name, display
+// name) of a single resident credential, identified by its credential ID,
+// on the selected authenticator. The credential's user ID is unchanged.
+func FIDO2UpdateCredentialUser(ctx context.Context, credID []byte, user libfido2.User, prompt LoginPrompt) error {
+	_, err := FIDO2CredentialManagement(ctx, prompt, &CredentialManagementOpts{
+		CredentialID: credID,
+		NewUser:      &user,
+	})
+	return err
+}
+
+func hasFIDO2Option(info *libfido2.DeviceInfo, name string) bool {
+	for _, opt := range info.Options {
+		if opt.Name == name {
+			return opt.Value == libfido2.True
+		}
+	}
+	return false
+}
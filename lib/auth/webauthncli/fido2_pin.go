@@ -0,0 +1,219 @@
+//go:build libfido2
+// +build libfido2
+
+// Copyright 2022 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webauthncli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/keys-pub/go-libfido2"
+)
+
+// PINChangePrompt is the user interface for FIDO2ChangePIN, which requires
+// both the authenticator's current PIN and the desired new one.
+type PINChangePrompt interface {
+	PromptTouch() error
+	PromptOldPIN() (string, error)
+	PromptNewPIN() (string, error)
+}
+
+// fido2ResetDevice is the libfido2.Device subset required by FIDO2Reset.
+type fido2ResetDevice interface {
+	FIDODevice
+	Reset() error
+}
+
+// fido2PINDevice is the libfido2.Device subset required by FIDO2SetPIN and
+// FIDO2ChangePIN.
+type fido2PINDevice interface {
+	FIDODevice
+	SetPIN(pin, oldPIN string) error
+}
+
+// ErrResetWindowExceeded is returned by FIDO2Reset when the authenticator
+// reports that the 10-second post-power-on window for authenticatorReset has
+// elapsed.
+var ErrResetWindowExceeded = errors.New("FIDO2Reset: reset window exceeded, unplug and replug the device then try again immediately")
+
+// ErrPINBlocked is returned by FIDO2SetPIN/FIDO2ChangePIN when the
+// authenticator reports that its PIN is permanently blocked (too many
+// consecutive incorrect attempts across power cycles). The authenticator
+// must be reset to recover.
+var ErrPINBlocked = errors.New("FIDO2: PIN blocked, the authenticator must be reset")
+
+// ErrPINAuthBlocked is returned by FIDO2SetPIN/FIDO2ChangePIN when the
+// authenticator reports that PIN authentication is blocked for the current
+// power cycle (too many consecutive incorrect attempts). Unplugging and
+// replugging the device clears this.
+var ErrPINAuthBlocked = errors.New("FIDO2: PIN authentication blocked, unplug and replug the device then try again")
+
+// minPINLength and maxPINLength are the CTAP2 bounds on client PIN length,
+// measured in UTF-8 code points.
+const (
+	minPINLength = 4
+	maxPINLength = 63
+)
+
+// validatePINLength checks pin against the CTAP2 PIN length bounds.
+func validatePINLength(pin string) error {
+	n := len([]rune(pin))
+	switch {
+	case n < minPINLength:
+		return fmt.Errorf("PIN too short, must be at least %v characters", minPINLength)
+	case n > maxPINLength:
+		return fmt.Errorf("PIN too long, must be at most %v characters", maxPINLength)
+	}
+	return nil
+}
+
+// translatePINError maps libfido2's blocked-PIN errors to their distinct,
+// exported equivalents, passing everything else through unchanged.
+func translatePINError(err error) error {
+	switch {
+	case errors.Is(err, libfido2.ErrPinBlocked):
+		return ErrPINBlocked
+	case errors.Is(err, libfido2.ErrPinAuthBlocked):
+		return ErrPINAuthBlocked
+	default:
+		return err
+	}
+}
+
+// FIDO2Reset wraps CTAP2's authenticatorReset command, wiping all resident
+// credentials and the PIN from the authenticator at devicePath.
+//
+// Unlike every other management operation in this package, FIDO2Reset never
+// auto-selects a device: reset is irreversible, so the caller must supply an
+// explicit devicePath (see FIDODeviceLocations) rather than letting a touch
+// on the wrong plugged-in authenticator wipe it by accident.
+//
+// CTAP2 only allows authenticatorReset within a short window after the
+// authenticator is powered on, so callers should prompt the user to unplug
+// and replug their device immediately before calling FIDO2Reset.
+func FIDO2Reset(ctx context.Context, devicePath string, prompt LoginPrompt) error {
+	switch {
+	case devicePath == "":
+		return errors.New("devicePath required")
+	case prompt == nil:
+		return errors.New("prompt required")
+	}
+
+	dev, err := FIDONewDevice(devicePath)
+	if err != nil {
+		return err
+	}
+	resetDev, ok := dev.(fido2ResetDevice)
+	if !ok {
+		return errors.New("selected device does not support reset")
+	}
+
+	if err := prompt.PromptTouch(); err != nil {
+		return err
+	}
+
+	err = resetDev.Reset()
+	switch {
+	case errors.Is(err, libfido2.ErrNotAllowed):
+		return ErrResetWindowExceeded
+	case err != nil:
+		return err
+	}
+	return nil
+}
+
+// FIDO2SetPIN sets the initial PIN on an authenticator that doesn't have one
+// configured yet. It fails if the authenticator already has a PIN — use
+// FIDO2ChangePIN instead.
+func FIDO2SetPIN(ctx context.Context, prompt LoginPrompt) error {
+	if prompt == nil {
+		return errors.New("prompt required")
+	}
+
+	dev, info, err := FIDO2SelectDevice(ctx, prompt)
+	if err != nil {
+		return err
+	}
+	pinDev, ok := dev.(fido2PINDevice)
+	if !ok {
+		return errors.New("selected device does not support PIN management")
+	}
+	if info != nil && hasFIDO2Option(info, "clientPin") {
+		return errors.New("device already has a PIN set, use FIDO2ChangePIN instead")
+	}
+
+	newPIN, err := prompt.PromptPIN()
+	if err != nil {
+		return err
+	}
+	if err := validatePINLength(newPIN); err != nil {
+		return err
+	}
+	return translatePINError(pinDev.SetPIN(newPIN, "" /* oldPIN */))
+}
+
+// FIDO2ChangePIN changes the PIN of an authenticator that already has one
+// configured, via an extended prompt asking for both the old and new PIN.
+func FIDO2ChangePIN(ctx context.Context, prompt PINChangePrompt) error {
+	if prompt == nil {
+		return errors.New("prompt required")
+	}
+
+	dev, _, err := fido2SelectDeviceForPINChange(ctx, prompt)
+	if err != nil {
+		return err
+	}
+	pinDev, ok := dev.(fido2PINDevice)
+	if !ok {
+		return errors.New("selected device does not support PIN management")
+	}
+
+	oldPIN, err := prompt.PromptOldPIN()
+	if err != nil {
+		return err
+	}
+	newPIN, err := prompt.PromptNewPIN()
+	if err != nil {
+		return err
+	}
+	if err := validatePINLength(newPIN); err != nil {
+		return err
+	}
+	return translatePINError(pinDev.SetPIN(newPIN, oldPIN))
+}
+
+// fido2SelectDeviceForPINChange adapts a PINChangePrompt into the LoginPrompt
+// shape FIDO2SelectDevice expects, since selection only needs a touch.
+func fido2SelectDeviceForPINChange(ctx context.Context, prompt PINChangePrompt) (FIDODevice, *libfido2.DeviceInfo, error) {
+	return FIDO2SelectDevice(ctx, pinChangeSelectPrompt{prompt})
+}
+
+type pinChangeSelectPrompt struct {
+	PINChangePrompt
+}
+
+func (p pinChangeSelectPrompt) PromptPIN() (string, error) {
+	return p.PromptOldPIN()
+}
+
+func (p pinChangeSelectPrompt) PromptCredential(creds []*CredentialInfo) (*CredentialInfo, error) {
+	if len(creds) == 0 {
+		return nil, errors.New("no credentials to choose from")
+	}
+	return creds[0], nil
+}
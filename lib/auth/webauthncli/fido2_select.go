@@ -0,0 +1,153 @@
+//go:build libfido2
+// +build libfido2
+
+// Copyright 2022 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webauthncli
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/keys-pub/go-libfido2"
+)
+
+// fido2SelectionDevice is the subset of libfido2.Device required to run the
+// CTAP2.1 authenticatorSelection command.
+type fido2SelectionDevice interface {
+	FIDODevice
+	Selection() error
+}
+
+// FIDO2SelectDevice arbitrates between every plugged-in device, returning
+// the first one the user interacts with (touches). It is the primitive
+// behind management operations (credential management, bio enrollment,
+// reset, PIN change) that must act on a single, unambiguous device, as well
+// as passwordless login, which must disambiguate before it can even know
+// which device to assert against.
+//
+// For CTAP2.1 devices (detected via the "FIDO_2_1" entry in DeviceInfo's
+// advertised versions), selection is done via the native
+// authenticatorSelection command, issued in parallel to every device; the
+// losers are canceled as soon as one reports success. CTAP2.0 devices don't
+// support the command, so a dummy MakeCredential with an unsatisfiable UV
+// requirement is used as a touch-only probe instead. CTAP1-only devices are
+// skipped, as neither technique works for them.
+func FIDO2SelectDevice(ctx context.Context, prompt LoginPrompt) (FIDODevice, *libfido2.DeviceInfo, error) {
+	if prompt == nil {
+		return nil, nil, errors.New("prompt required")
+	}
+
+	// Fast path: a single plugged-in device has nothing to disambiguate, so
+	// skip the Selection()/dummy-MakeCredential round-trip (and the touch it
+	// would require) and return it directly.
+	if locs, err := FIDODeviceLocations(); err == nil && len(locs) == 1 {
+		if dev, err := FIDONewDevice(locs[0].Path); err == nil {
+			info, _ := dev.Info() // CTAP1-only devices error here, that's fine.
+			return dev, info, nil
+		}
+	}
+
+	type result struct {
+		dev fidoDeviceInfo
+		err error
+	}
+	resultC := make(chan result)
+
+	pollCtx, cancelPoll := context.WithCancel(ctx)
+	defer cancelPoll()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	racers := make([]fidoDeviceInfo, 0)
+
+	probe := func(dev fidoDeviceInfo) {
+		defer wg.Done()
+
+		sel, isSelectable := dev.dev.(fido2SelectionDevice)
+
+		var err error
+		switch {
+		case dev.isCTAP21() && isSelectable:
+			err = sel.Selection()
+		case dev.isFIDO2():
+			// CTAP2.0 fallback: issue a MakeCredential that can never succeed, but
+			// still blocks on user presence, giving us a touch-only probe.
+			_, err = dev.dev.MakeCredential(
+				make([]byte, 32),
+				libfido2.RelyingParty{ID: "selection-probe.invalid"},
+				libfido2.User{ID: []byte("selection-probe")},
+				libfido2.ES256,
+				"",
+				&libfido2.MakeCredentialOpts{UV: libfido2.True},
+			)
+		default:
+			return // CTAP1-only devices can't be selected this way.
+		}
+
+		switch {
+		case err == nil, errors.Is(err, libfido2.ErrUnsupportedOption):
+			// Either Selection() succeeded outright, or the CTAP2.0 probe got far
+			// enough to prove user presence (the credential itself is expected to
+			// be rejected).
+		case errors.Is(err, libfido2.ErrKeepaliveCancel):
+			return // lost the race to another device.
+		default:
+			select {
+			case resultC <- result{err: err}:
+			case <-pollCtx.Done(): // a winner was already picked
+			}
+			return
+		}
+
+		select {
+		case resultC <- result{dev: dev}:
+		case <-pollCtx.Done(): // a winner was already picked
+		}
+	}
+
+	go pollDevices(pollCtx, func(dev fidoDeviceInfo) {
+		mu.Lock()
+		racers = append(racers, dev)
+		mu.Unlock()
+
+		wg.Add(1)
+		go probe(dev)
+	})
+
+	var winner result
+	select {
+	case winner = <-resultC:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	cancelPoll()
+
+	// Cancel every other device still racing, then wait for them to unwind.
+	mu.Lock()
+	for _, dev := range racers {
+		if dev.path != winner.dev.path {
+			_ = dev.dev.Cancel()
+		}
+	}
+	mu.Unlock()
+	wg.Wait()
+
+	if winner.err != nil {
+		return nil, nil, winner.err
+	}
+	return winner.dev.dev, winner.dev.info, nil
+}
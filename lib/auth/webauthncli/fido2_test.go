@@ -21,9 +21,7 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
-	"fmt"
 	"os"
-	"sync"
 	"testing"
 	"time"
 
@@ -32,7 +30,6 @@ import (
 	"github.com/fxamacker/cbor/v2"
 	"github.com/google/go-cmp/cmp"
 	"github.com/gravitational/teleport/api/client/proto"
-	"github.com/gravitational/teleport/lib/auth/mocku2f"
 	"github.com/keys-pub/go-libfido2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -40,6 +37,7 @@ import (
 	wanpb "github.com/gravitational/teleport/api/types/webauthn"
 	wanlib "github.com/gravitational/teleport/lib/auth/webauthn"
 	wancli "github.com/gravitational/teleport/lib/auth/webauthncli"
+	"github.com/gravitational/teleport/lib/auth/webauthncli/wanclitest"
 )
 
 var makeCredentialAuthDataRaw, makeCredentialAuthDataCBOR, makeCredentialSig []byte
@@ -140,6 +138,20 @@ func (p pinCancelPrompt) PromptTouch() error {
 	return nil
 }
 
+// fixedPINPrompt always answers PromptPIN with a fixed (possibly incorrect)
+// PIN, for tests exercising PIN validation.
+type fixedPINPrompt struct {
+	simplePicker
+
+	pin string
+}
+
+func (p *fixedPINPrompt) PromptPIN() (string, error) {
+	return p.pin, nil
+}
+
+func (p *fixedPINPrompt) PromptTouch() error { return nil }
+
 func TestIsFIDO2Available(t *testing.T) {
 	const fido2Key = "TELEPORT_FIDO2"
 	tests := []struct {
@@ -237,7 +249,7 @@ func TestFIDO2Login(t *testing.T) {
 	})
 	// legacy1 is an authenticator registered using the U2F App ID.
 	legacy1 := mustNewFIDO2Device("/legacy1", "" /* pin */, &libfido2.DeviceInfo{Options: authOpts})
-	legacy1.wantRPID = appID
+	legacy1.WantRPID = appID
 
 	challenge, err := protocol.CreateChallenge()
 	require.NoError(t, err, "CreateChallenge failed")
@@ -272,28 +284,28 @@ func TestFIDO2Login(t *testing.T) {
 				go func() {
 					// Simulate delayed user press.
 					time.Sleep(100 * time.Millisecond)
-					auth1.setUP()
+					auth1.SetUP()
 				}()
 			},
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: auth1.credentialID()},
+					{CredentialID: auth1.CredentialID()},
 				}
 				return &cp
 			},
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, auth1.credentialID(), resp.RawId, "RawId mismatch")
+				assert.Equal(t, auth1.CredentialID(), resp.RawId, "RawId mismatch")
 			},
 		},
 		{
 			name:  "pin protected device",
 			fido2: newFakeFIDO2(pin1),
-			setUP: pin1.setUP,
+			setUP: pin1.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: pin1.credentialID()},
+					{CredentialID: pin1.CredentialID()},
 				}
 				return &cp
 			},
@@ -301,11 +313,11 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "biometric device",
 			fido2: newFakeFIDO2(bio1),
-			setUP: bio1.setUP,
+			setUP: bio1.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: bio1.credentialID()},
+					{CredentialID: bio1.CredentialID()},
 				}
 				return &cp
 			},
@@ -313,11 +325,11 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "legacy device (AppID)",
 			fido2: newFakeFIDO2(legacy1),
-			setUP: legacy1.setUP,
+			setUP: legacy1.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: legacy1.credentialID()},
+					{CredentialID: legacy1.CredentialID()},
 				}
 				cp.Response.Extensions = protocol.AuthenticationExtensions{
 					wanlib.AppIDExtension: appID,
@@ -336,14 +348,14 @@ func TestFIDO2Login(t *testing.T) {
 				bio1,
 				legacy1,
 			),
-			setUP: bio1.setUP,
+			setUP: bio1.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: auth1.credentialID()},
-					{CredentialID: pin1.credentialID()},
-					{CredentialID: bio1.credentialID()},
-					{CredentialID: legacy1.credentialID()},
+					{CredentialID: auth1.CredentialID()},
+					{CredentialID: pin1.CredentialID()},
+					{CredentialID: bio1.CredentialID()},
+					{CredentialID: legacy1.CredentialID()},
 				}
 				cp.Response.Extensions = protocol.AuthenticationExtensions{
 					wanlib.AppIDExtension: appID,
@@ -351,7 +363,7 @@ func TestFIDO2Login(t *testing.T) {
 				return &cp
 			},
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, bio1.credentialID(), resp.RawId, "RawId mismatch (want bio1)")
+				assert.Equal(t, bio1.CredentialID(), resp.RawId, "RawId mismatch (want bio1)")
 			},
 		},
 		{
@@ -362,13 +374,13 @@ func TestFIDO2Login(t *testing.T) {
 				bio1,
 				legacy1, // doesn't match RPID or AppID
 			),
-			setUP: auth1.setUP,
+			setUP: auth1.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: auth1.credentialID()},
-					{CredentialID: bio1.credentialID()},
-					{CredentialID: legacy1.credentialID()},
+					{CredentialID: auth1.CredentialID()},
+					{CredentialID: bio1.CredentialID()},
+					{CredentialID: legacy1.CredentialID()},
 				}
 				cp.Response.Extensions = protocol.AuthenticationExtensions{
 					wanlib.AppIDExtension: "https://badexample.com",
@@ -376,7 +388,7 @@ func TestFIDO2Login(t *testing.T) {
 				return &cp
 			},
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, auth1.credentialID(), resp.RawId, "RawId mismatch (want auth1)")
+				assert.Equal(t, auth1.CredentialID(), resp.RawId, "RawId mismatch (want auth1)")
 			},
 		},
 		{
@@ -386,19 +398,19 @@ func TestFIDO2Login(t *testing.T) {
 				pin1, pin2,
 				bio1,
 			),
-			setUP: pin2.setUP,
+			setUP: pin2.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: auth1.credentialID()},
-					{CredentialID: pin1.credentialID()},
-					{CredentialID: pin2.credentialID()},
-					{CredentialID: bio1.credentialID()},
+					{CredentialID: auth1.CredentialID()},
+					{CredentialID: pin1.CredentialID()},
+					{CredentialID: pin2.CredentialID()},
+					{CredentialID: bio1.CredentialID()},
 				}
 				return &cp
 			},
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, pin2.credentialID(), resp.RawId, "RawId mismatch (want pin2)")
+				assert.Equal(t, pin2.CredentialID(), resp.RawId, "RawId mismatch (want pin2)")
 			},
 		},
 		{
@@ -409,7 +421,7 @@ func TestFIDO2Login(t *testing.T) {
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: auth1.credentialID()},
+					{CredentialID: auth1.CredentialID()},
 				}
 				return &cp
 			},
@@ -423,9 +435,9 @@ func TestFIDO2Login(t *testing.T) {
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: auth1.credentialID()},
-					{CredentialID: pin1.credentialID()},
-					{CredentialID: bio1.credentialID()},
+					{CredentialID: auth1.CredentialID()},
+					{CredentialID: pin1.CredentialID()},
+					{CredentialID: bio1.CredentialID()},
 				}
 				return &cp
 			},
@@ -439,7 +451,7 @@ func TestFIDO2Login(t *testing.T) {
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = []protocol.CredentialDescriptor{
-					{CredentialID: auth1.credentialID()},
+					{CredentialID: auth1.CredentialID()},
 				}
 				return &cp
 			},
@@ -448,8 +460,8 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:   "NOK cancel after PIN",
 			fido2:  newFakeFIDO2(pin3, bio2),        // pin3 and bio2 have resident credentials
-			setUP:  pin3.setUP,                      // user chooses pin3, but cancels before further touches
-			prompt: &pinCancelPrompt{pin: pin3.pin}, // cancel set on test body
+			setUP:  pin3.SetUP,                      // user chooses pin3, but cancels before further touches
+			prompt: &pinCancelPrompt{pin: pin3.PIN}, // cancel set on test body
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = nil // passwordless forces PIN
@@ -461,7 +473,7 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "passwordless pin",
 			fido2: newFakeFIDO2(pin3),
-			setUP: pin3.setUP,
+			setUP: pin3.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = nil
@@ -470,7 +482,7 @@ func TestFIDO2Login(t *testing.T) {
 			},
 			prompt: pin3,
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, pin3.credentials[0].ID, resp.RawId, "RawId mismatch (want %q resident credential)", alpacaName)
+				assert.Equal(t, pin3.Credentials[0].ID, resp.RawId, "RawId mismatch (want %q resident credential)", alpacaName)
 				assert.Equal(t, alpacaID, resp.Response.UserHandle, "UserHandle mismatch (want %q)", alpacaName)
 			},
 			wantUser: "", // single account response
@@ -478,7 +490,7 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "passwordless biometric (llama)",
 			fido2: newFakeFIDO2(bio2),
-			setUP: bio2.setUP,
+			setUP: bio2.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = nil
@@ -490,7 +502,7 @@ func TestFIDO2Login(t *testing.T) {
 				User: llamaName,
 			},
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, bio2.credentials[0].ID, resp.RawId, "RawId mismatch (want %q resident credential)", llamaName)
+				assert.Equal(t, bio2.Credentials[0].ID, resp.RawId, "RawId mismatch (want %q resident credential)", llamaName)
 				assert.Equal(t, llamaID, resp.Response.UserHandle, "UserHandle mismatch (want %q)", llamaName)
 			},
 			wantUser: llamaName,
@@ -498,7 +510,7 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "passwordless biometric (alpaca)",
 			fido2: newFakeFIDO2(bio2),
-			setUP: bio2.setUP,
+			setUP: bio2.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = nil
@@ -510,7 +522,7 @@ func TestFIDO2Login(t *testing.T) {
 				User: alpacaName,
 			},
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, bio2.credentials[1].ID, resp.RawId, "RawId mismatch (want %q resident credential)", alpacaName)
+				assert.Equal(t, bio2.Credentials[1].ID, resp.RawId, "RawId mismatch (want %q resident credential)", alpacaName)
 				assert.Equal(t, alpacaID, resp.Response.UserHandle, "UserHandle mismatch (want %q)", alpacaName)
 			},
 			wantUser: alpacaName,
@@ -518,7 +530,7 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "passwordless single-choice credential picker",
 			fido2: newFakeFIDO2(pin3),
-			setUP: pin3.setUP,
+			setUP: pin3.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = nil
@@ -527,7 +539,7 @@ func TestFIDO2Login(t *testing.T) {
 			},
 			prompt: pin3,
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, pin3.credentials[0].ID, resp.RawId, "RawId mismatch (want %q resident credential)", alpacaName)
+				assert.Equal(t, pin3.Credentials[0].ID, resp.RawId, "RawId mismatch (want %q resident credential)", alpacaName)
 				assert.Equal(t, alpacaID, resp.Response.UserHandle, "UserHandle mismatch (want %q)", alpacaName)
 			},
 			wantUser: "", // single account response
@@ -535,7 +547,7 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "passwordless multi-choice credential picker",
 			fido2: newFakeFIDO2(bio2),
-			setUP: bio2.setUP,
+			setUP: bio2.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = nil
@@ -544,7 +556,7 @@ func TestFIDO2Login(t *testing.T) {
 			},
 			prompt: bio2, // picks first credential from list.
 			assertResponse: func(t *testing.T, resp *wanpb.CredentialAssertionResponse) {
-				assert.Equal(t, bio2.credentials[0].ID, resp.RawId, "RawId mismatch (want %q resident credential)", llamaName)
+				assert.Equal(t, bio2.Credentials[0].ID, resp.RawId, "RawId mismatch (want %q resident credential)", llamaName)
 				assert.Equal(t, llamaID, resp.Response.UserHandle, "UserHandle mismatch (want %q)", llamaName)
 			},
 			wantUser: llamaName,
@@ -552,7 +564,7 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "NOK passwordless no credentials",
 			fido2: newFakeFIDO2(bio1),
-			setUP: bio1.setUP,
+			setUP: bio1.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = nil
@@ -565,7 +577,7 @@ func TestFIDO2Login(t *testing.T) {
 		{
 			name:  "NOK passwordless unknown user",
 			fido2: newFakeFIDO2(bio2),
-			setUP: bio2.setUP,
+			setUP: bio2.SetUP,
 			createAssertion: func() *wanlib.CredentialAssertion {
 				cp := *baseAssertion
 				cp.Response.AllowedCredentials = nil
@@ -581,8 +593,8 @@ func TestFIDO2Login(t *testing.T) {
 	}
 	for _, test := range tests {
 		runTest := func(t *testing.T, f2 *fakeFIDO2) {
-			f2.setCallbacks()
-			test.setUP()
+			f2.SetCallbacks()
+			test.SetUP()
 
 			timeout := test.timeout
 			if timeout == 0 {
@@ -661,7 +673,7 @@ func TestFIDO2Login(t *testing.T) {
 			runTest(t, test.fido2)
 		})
 		t.Run(test.name+"/nonMetered", func(t *testing.T) {
-			runTest(t, test.fido2.withNonMeteredLocations())
+			runTest(t, test.fido2.WithNonMeteredLocations())
 		})
 	}
 }
@@ -679,10 +691,10 @@ func TestFIDO2Login_retryUVFailures(t *testing.T) {
 			Name: user,
 		},
 	})
-	pin1.failUV = true // fail UV regardless of PIN
+	pin1.FailUV(true) // fail UV regardless of PIN
 
-	f2 := newFakeFIDO2(pin1).withNonMeteredLocations()
-	f2.setCallbacks()
+	f2 := newFakeFIDO2(pin1).WithNonMeteredLocations()
+	f2.SetCallbacks()
 
 	const rpID = "example.com"
 	const origin = "https://example.com"
@@ -695,7 +707,7 @@ func TestFIDO2Login_retryUVFailures(t *testing.T) {
 		},
 	}
 
-	pin1.setUP()
+	pin1.SetUP()
 	_, _, err := wancli.FIDO2Login(ctx, origin, assertion, pin1 /* prompt */, nil /* opts */)
 	require.NoError(t, err, "FIDO2Login failed UV retry")
 }
@@ -735,8 +747,8 @@ func TestFIDO2Login_singleResidentCredential(t *testing.T) {
 			},
 		})
 
-	f2 := newFakeFIDO2(oneCredential, manyCredentials).withNonMeteredLocations()
-	f2.setCallbacks()
+	f2 := newFakeFIDO2(oneCredential, manyCredentials).WithNonMeteredLocations()
+	f2.SetCallbacks()
 
 	const rpID = "example.com"
 	const origin = "https://example.com"
@@ -761,13 +773,13 @@ func TestFIDO2Login_singleResidentCredential(t *testing.T) {
 	}{
 		{
 			name:       "single credential with empty user",
-			up:         oneCredential.setUP,
+			up:         oneCredential.SetUP,
 			prompt:     oneCredential,
 			wantUserID: user1ID,
 		},
 		{
 			name:   "single credential with correct user",
-			up:     oneCredential.setUP,
+			up:     oneCredential.SetUP,
 			prompt: oneCredential,
 			opts: &wancli.LoginOpts{
 				User: user1Name, // happens to match
@@ -776,7 +788,7 @@ func TestFIDO2Login_singleResidentCredential(t *testing.T) {
 		},
 		{
 			name:   "single credential with ignored user",
-			up:     oneCredential.setUP,
+			up:     oneCredential.SetUP,
 			prompt: oneCredential,
 			opts: &wancli.LoginOpts{
 				User: user2Name, // ignored, we just can't know
@@ -785,7 +797,7 @@ func TestFIDO2Login_singleResidentCredential(t *testing.T) {
 		},
 		{
 			name:   "multi credentials",
-			up:     manyCredentials.setUP,
+			up:     manyCredentials.SetUP,
 			prompt: manyCredentials,
 			opts: &wancli.LoginOpts{
 				User: user2Name, // respected, authenticator returns the data
@@ -827,9 +839,12 @@ func TestFIDO2Login_PromptTouch(t *testing.T) {
 	auth1 := mustNewFIDO2Device("/auth1", "" /* pin */, &libfido2.DeviceInfo{
 		Options: authOpts,
 	})
-	// pin1 is a FIDO2 authenticator with a PIN and resident credentials.
+	// pin1 is a CTAP2.1 FIDO2 authenticator with a PIN and resident
+	// credentials, advertising support for the native authenticatorSelection
+	// command.
 	pin1 := mustNewFIDO2Device("/pin1", "supersecretpin1", &libfido2.DeviceInfo{
-		Options: pinOpts,
+		Versions: []string{"FIDO_2_0", "FIDO_2_1"},
+		Options:  pinOpts,
 	}, &libfido2.Credential{
 		ID: []byte{1, 1, 1, 1},
 		User: libfido2.User{
@@ -837,9 +852,11 @@ func TestFIDO2Login_PromptTouch(t *testing.T) {
 			Name: "alpaca",
 		},
 	})
-	// bio1 is a biometric authenticator with configured resident credentials.
+	// bio1 is a CTAP2.1 biometric authenticator with configured resident
+	// credentials.
 	bio1 := mustNewFIDO2Device("/bio1", "supersecretBIO1pin", &libfido2.DeviceInfo{
-		Options: bioOpts,
+		Versions: []string{"FIDO_2_0", "FIDO_2_1"},
+		Options:  bioOpts,
 	}, &libfido2.Credential{
 		ID: []byte{1, 1, 1, 2},
 		User: libfido2.User{
@@ -861,15 +878,15 @@ func TestFIDO2Login_PromptTouch(t *testing.T) {
 			AllowedCredentials: []protocol.CredentialDescriptor{
 				{
 					Type:         protocol.PublicKeyCredentialType,
-					CredentialID: auth1.credentialID(),
+					CredentialID: auth1.CredentialID(),
 				},
 				{
 					Type:         protocol.PublicKeyCredentialType,
-					CredentialID: pin1.credentialID(),
+					CredentialID: pin1.CredentialID(),
 				},
 				{
 					Type:         protocol.PublicKeyCredentialType,
-					CredentialID: bio1.credentialID(),
+					CredentialID: bio1.CredentialID(),
 				},
 			},
 		},
@@ -899,7 +916,7 @@ func TestFIDO2Login_PromptTouch(t *testing.T) {
 		},
 		{
 			name:        "Passwordless PIN plugged requires two touches",
-			fido2:       newFakeFIDO2(pin1).withNonMeteredLocations(),
+			fido2:       newFakeFIDO2(pin1).WithNonMeteredLocations(),
 			assertion:   pwdlessAssertion,
 			prompt:      pin1,
 			wantTouches: 2,
@@ -912,17 +929,17 @@ func TestFIDO2Login_PromptTouch(t *testing.T) {
 			wantTouches: 2,
 		},
 		{
-			name:      "Passwordless Bio requires one touch",
+			name:      "Passwordless Bio requires selection plus assertion touch",
 			fido2:     newFakeFIDO2(bio1),
 			assertion: pwdlessAssertion,
 			prompt:    bio1,
 			opts: &wancli.LoginOpts{
 				User: "llama",
 			},
-			wantTouches: 1,
+			wantTouches: 2,
 		},
 		{
-			name:        "Passwordless with multiple devices requires two touches",
+			name:        "Passwordless with multiple CTAP2.1 devices requires a selection touch plus an assertion touch",
 			fido2:       newFakeFIDO2(pin1, bio1),
 			assertion:   pwdlessAssertion,
 			prompt:      pin1,
@@ -931,7 +948,7 @@ func TestFIDO2Login_PromptTouch(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			test.fido2.setCallbacks()
+			test.fido2.SetCallbacks()
 
 			// Set a timeout, just in case.
 			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
@@ -945,14 +962,56 @@ func TestFIDO2Login_PromptTouch(t *testing.T) {
 	}
 }
 
+// TestFIDO2Login_onInteraction exercises VirtualDevice.OnInteraction and
+// VirtualHub.Replace, which let a caller outside this package (where
+// resetFIDO2AfterTests isn't available) script custom touch behavior and
+// install/restore a VirtualHub with a single call.
+func TestFIDO2Login_onInteraction(t *testing.T) {
+	const rpID = "example.com"
+	const origin = "https://example.com"
+
+	var touches int
+	auth1 := mustNewFIDO2Device("/auth1", "" /* pin */, &libfido2.DeviceInfo{
+		Options: authOpts,
+	})
+	auth1.OnInteraction = func() error {
+		touches++
+		auth1.SetUP()
+		return nil
+	}
+
+	newFakeFIDO2(auth1).Replace(t)
+
+	assertion := &wanlib.CredentialAssertion{
+		Response: protocol.PublicKeyCredentialRequestOptions{
+			Challenge:      make([]byte, 32),
+			RelyingPartyID: rpID,
+			AllowedCredentials: []protocol.CredentialDescriptor{
+				{
+					Type:         protocol.PublicKeyCredentialType,
+					CredentialID: auth1.CredentialID(),
+				},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, _, err := wancli.FIDO2Login(ctx, origin, assertion, auth1, nil /* opts */)
+	require.NoError(t, err, "FIDO2Login errored")
+	assert.Equal(t, 1, touches, "OnInteraction wasn't invoked the expected number of times")
+}
+
 func TestFIDO2Login_u2fDevice(t *testing.T) {
 	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
 
 	dev := mustNewFIDO2Device("/u2f", "" /* pin */, nil /* info */)
-	dev.u2fOnly = true
+	dev.U2FOnly = true
 
-	f2 := newFakeFIDO2(dev).withNonMeteredLocations()
-	f2.setCallbacks()
+	f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+	f2.SetCallbacks()
 
 	const rpID = "example.com"
 	const origin = "https://example.com"
@@ -981,7 +1040,7 @@ func TestFIDO2Login_u2fDevice(t *testing.T) {
 		},
 	}
 
-	dev.setUP() // simulate touch
+	dev.SetUP() // simulate touch
 	ccr, err := wancli.FIDO2Register(ctx, origin, cc, dev /* prompt */)
 	require.NoError(t, err, "FIDO2Register errored")
 
@@ -999,9 +1058,155 @@ func TestFIDO2Login_u2fDevice(t *testing.T) {
 		},
 	}
 
-	dev.setUP() // simulate touch
+	// other is an unrelated U2F device, plugged in alongside dev for login but
+	// never registered for this credential. Login should succeed via dev
+	// alone, with other's rejection (ErrNoCredentials) treated as a
+	// non-interactive filter-out rather than promoted to
+	// ErrUsingNonRegisteredDevice.
+	other := mustNewFIDO2Device("/other-u2f", "" /* pin */, nil /* info */)
+	other.U2FOnly = true
+	newFakeFIDO2(dev, other).WithNonMeteredLocations().SetCallbacks()
+
+	dev.SetUP() // simulate touch
 	_, _, err = wancli.FIDO2Login(ctx, origin, assertion, dev /* prompt */, nil /* opts */)
 	assert.NoError(t, err, "FIDO2Login errored")
+	assert.False(t, other.Canceled(), "other should have been ignored without needing cancellation")
+}
+
+func TestFIDO2Login_ignoresUnregisteredU2F(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
+
+	// fido1 is a FIDO2 authenticator, registered for the login below.
+	fido1 := mustNewFIDO2Device("/fido1", "" /* pin */, &libfido2.DeviceInfo{
+		Options: authOpts,
+	})
+	// u2f1 is a U2F-only authenticator, never registered for this credential.
+	u2f1 := mustNewFIDO2Device("/u2f1", "" /* pin */, nil /* info */)
+	u2f1.U2FOnly = true
+
+	f2 := newFakeFIDO2(fido1, u2f1).WithNonMeteredLocations()
+	f2.SetCallbacks()
+
+	const rpID = "example.com"
+	const origin = "https://example.com"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assertion := &wanlib.CredentialAssertion{
+		Response: protocol.PublicKeyCredentialRequestOptions{
+			Challenge:      []byte{1, 2, 3, 4, 5}, // arbitrary
+			RelyingPartyID: rpID,
+			AllowedCredentials: []protocol.CredentialDescriptor{
+				{CredentialID: fido1.CredentialID()},
+			},
+			UserVerification: protocol.VerificationDiscouraged,
+		},
+	}
+
+	fido1.SetUP() // simulate touch on the registered device only.
+	_, _, err := wancli.FIDO2Login(ctx, origin, assertion, fido1 /* prompt */, nil /* opts */)
+	require.NoError(t, err, "FIDO2Login errored")
+	assert.False(t, u2f1.Canceled(), "u2f1 should have been ignored without needing cancellation")
+}
+
+// TestFIDO2Login_preflight exercises the silent (UP=false) preflight that
+// keeps non-matching FIDO2 devices from ever being armed for touch during an
+// MFA login.
+func TestFIDO2Login_preflight(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
+
+	const rpID = "example.com"
+	const origin = "https://example.com"
+
+	t.Run("only the matching device is prompted", func(t *testing.T) {
+		registered := mustNewFIDO2Device("/registered", "" /* pin */, &libfido2.DeviceInfo{
+			Options: authOpts,
+		})
+		other := mustNewFIDO2Device("/other", "" /* pin */, &libfido2.DeviceInfo{
+			Options: authOpts,
+		})
+
+		newFakeFIDO2(registered, other).WithNonMeteredLocations().SetCallbacks()
+
+		assertion := &wanlib.CredentialAssertion{
+			Response: protocol.PublicKeyCredentialRequestOptions{
+				Challenge:      []byte{1, 2, 3, 4, 5}, // arbitrary
+				RelyingPartyID: rpID,
+				AllowedCredentials: []protocol.CredentialDescriptor{
+					{CredentialID: registered.CredentialID()},
+				},
+				UserVerification: protocol.VerificationDiscouraged,
+			},
+		}
+
+		// other is never touched: if it weren't filtered out by preflight, the
+		// login would hang until ctx expires waiting for its presence.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		registered.SetUP()
+		_, _, err := wancli.FIDO2Login(ctx, origin, assertion, registered /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2Login errored")
+		assert.False(t, other.Canceled(), "other should have been filtered out by preflight, not canceled")
+	})
+
+	t.Run("zero matches across all devices is rejected without a touch", func(t *testing.T) {
+		dev1 := mustNewFIDO2Device("/dev1", "" /* pin */, &libfido2.DeviceInfo{Options: authOpts})
+		dev2 := mustNewFIDO2Device("/dev2", "" /* pin */, &libfido2.DeviceInfo{Options: authOpts})
+
+		newFakeFIDO2(dev1, dev2).WithNonMeteredLocations().SetCallbacks()
+
+		assertion := &wanlib.CredentialAssertion{
+			Response: protocol.PublicKeyCredentialRequestOptions{
+				Challenge:      []byte{1, 2, 3, 4, 5}, // arbitrary
+				RelyingPartyID: rpID,
+				AllowedCredentials: []protocol.CredentialDescriptor{
+					{CredentialID: []byte("not-registered-anywhere")},
+				},
+				UserVerification: protocol.VerificationDiscouraged,
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_, _, err := wancli.FIDO2Login(ctx, origin, assertion, noopPrompt{}, nil /* opts */)
+		require.ErrorIs(t, err, wancli.ErrUsingNonRegisteredDevice, "FIDO2Login error mismatch")
+		assert.False(t, dev1.Canceled(), "dev1 should never have been armed for touch")
+		assert.False(t, dev2.Canceled(), "dev2 should never have been armed for touch")
+	})
+
+	t.Run("a device that errors during preflight is retained as a fallback", func(t *testing.T) {
+		flaky := mustNewFIDO2Device("/flaky", "" /* pin */, &libfido2.DeviceInfo{
+			Options: authOpts,
+		})
+		// The first Assertion call (the silent preflight) fails with an
+		// unrelated error; flaky should still be raced for the real request.
+		flaky.AssertionErrors = []error{errors.New("preflight transport hiccup")}
+
+		newFakeFIDO2(flaky).WithNonMeteredLocations().SetCallbacks()
+
+		assertion := &wanlib.CredentialAssertion{
+			Response: protocol.PublicKeyCredentialRequestOptions{
+				Challenge:      []byte{1, 2, 3, 4, 5}, // arbitrary
+				RelyingPartyID: rpID,
+				AllowedCredentials: []protocol.CredentialDescriptor{
+					{CredentialID: flaky.CredentialID()},
+				},
+				UserVerification: protocol.VerificationDiscouraged,
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		flaky.SetUP()
+		_, _, err := wancli.FIDO2Login(ctx, origin, assertion, flaky /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2Login errored")
+	})
 }
 
 func TestFIDO2Login_bioErrorHandling(t *testing.T) {
@@ -1017,8 +1222,8 @@ func TestFIDO2Login_bioErrorHandling(t *testing.T) {
 		},
 	})
 
-	f2 := newFakeFIDO2(bio).withNonMeteredLocations()
-	f2.setCallbacks()
+	f2 := newFakeFIDO2(bio).WithNonMeteredLocations()
+	f2.SetCallbacks()
 
 	// Prepare a passwordless assertion.
 	// MFA would do as well; both are realistic here.
@@ -1039,12 +1244,12 @@ func TestFIDO2Login_bioErrorHandling(t *testing.T) {
 	}{
 		{
 			name:               "success (sanity check)",
-			setAssertionErrors: func() { bio.assertionErrors = nil },
+			setAssertionErrors: func() { bio.AssertionErrors = nil },
 		},
 		{
 			name: "libfido2 error 60 fails with custom message",
 			setAssertionErrors: func() {
-				bio.assertionErrors = []error{
+				bio.AssertionErrors = []error{
 					libfido2.Error{Code: 60},
 				}
 			},
@@ -1053,7 +1258,7 @@ func TestFIDO2Login_bioErrorHandling(t *testing.T) {
 		{
 			name: "libfido2 error 63 retried",
 			setAssertionErrors: func() {
-				bio.assertionErrors = []error{
+				bio.AssertionErrors = []error{
 					libfido2.Error{Code: 63},
 					libfido2.Error{Code: 63},
 				}
@@ -1062,7 +1267,7 @@ func TestFIDO2Login_bioErrorHandling(t *testing.T) {
 		{
 			name: "error retry has a limit",
 			setAssertionErrors: func() {
-				bio.assertionErrors = []error{
+				bio.AssertionErrors = []error{
 					libfido2.Error{Code: 63},
 					libfido2.Error{Code: 63},
 					libfido2.Error{Code: 63},
@@ -1091,12 +1296,201 @@ func TestFIDO2Login_bioErrorHandling(t *testing.T) {
 	}
 }
 
+func TestFIDO2HMACSecret(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
+
+	const rpID = "example.com"
+	const origin = "https://example.com"
+
+	// hmac1 supports the hmac-secret extension and holds one resident
+	// credential.
+	hmac1 := mustNewFIDO2Device("/hmac1", "supersecrethmacpin", &libfido2.DeviceInfo{
+		Options:    pinOpts,
+		Extensions: []string{"hmac-secret"},
+	}, &libfido2.Credential{
+		User: libfido2.User{ID: []byte{1, 1, 1}, Name: "llama"},
+	})
+	// noHMAC1 is otherwise identical, but doesn't advertise the extension.
+	noHMAC1 := mustNewFIDO2Device("/nohmac1", "supersecretnohmacpin", &libfido2.DeviceInfo{
+		Options: pinOpts,
+	}, &libfido2.Credential{
+		User: libfido2.User{ID: []byte{2, 2, 2}, Name: "alpaca"},
+	})
+
+	challenge, err := protocol.CreateChallenge()
+	require.NoError(t, err, "CreateChallenge failed")
+
+	baseCC := &wanlib.CredentialCreation{
+		Response: protocol.PublicKeyCredentialCreationOptions{
+			Challenge: challenge,
+			RelyingParty: protocol.RelyingPartyEntity{
+				ID: rpID,
+			},
+			Parameters: []protocol.CredentialParameter{
+				{Type: protocol.PublicKeyCredentialType, Algorithm: webauthncose.AlgES256},
+			},
+			AuthenticatorSelection: protocol.AuthenticatorSelection{
+				UserVerification: protocol.VerificationDiscouraged,
+			},
+			Extensions: protocol.AuthenticationExtensions{
+				"hmac-secret": true,
+			},
+		},
+	}
+
+	t.Run("register enables the extension when supported", func(t *testing.T) {
+		f2 := newFakeFIDO2(hmac1).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		hmac1.SetUP()
+		ccr, err := wancli.FIDO2Register(ctx, origin, baseCC, hmac1 /* prompt */)
+		require.NoError(t, err, "FIDO2Register failed")
+		assert.True(t, ccr.GetWebauthn().Extensions.HmacCreateSecret, "HmacCreateSecret not enabled")
+	})
+
+	t.Run("register leaves the extension disabled when unsupported", func(t *testing.T) {
+		f2 := newFakeFIDO2(noHMAC1).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		noHMAC1.SetUP()
+		ccr, err := wancli.FIDO2Register(ctx, origin, baseCC, noHMAC1 /* prompt */)
+		require.NoError(t, err, "FIDO2Register failed")
+		assert.False(t, ccr.GetWebauthn().Extensions.HmacCreateSecret, "HmacCreateSecret unexpectedly enabled")
+	})
+
+	t.Run("login derives a deterministic secret", func(t *testing.T) {
+		f2 := newFakeFIDO2(hmac1).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		salt1 := []byte("0123456789abcdef0123456789abcdef")
+		assertion := &wanlib.CredentialAssertion{
+			Response: protocol.PublicKeyCredentialRequestOptions{
+				Challenge:        []byte{1, 2, 3, 4, 5}, // arbitrary
+				RelyingPartyID:   rpID,
+				UserVerification: protocol.VerificationDiscouraged,
+				Extensions: protocol.AuthenticationExtensions{
+					"prf": map[string]interface{}{"salt1": salt1},
+				},
+			},
+		}
+
+		hmac1.SetUP()
+		resp, _, err := wancli.FIDO2Login(ctx, origin, assertion, hmac1 /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2Login failed")
+
+		secret := resp.GetWebauthn().Extensions.HmacGetSecret
+		require.NotEmpty(t, secret, "HmacGetSecret not returned")
+
+		// Same RP/salt, run again for a deterministic comparison.
+		hmac1.SetUP()
+		resp2, _, err := wancli.FIDO2Login(ctx, origin, assertion, hmac1 /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2Login failed")
+		assert.Equal(t, secret, resp2.GetWebauthn().Extensions.HmacGetSecret, "hmac-secret output not deterministic")
+	})
+
+	t.Run("login omits the secret when unsupported", func(t *testing.T) {
+		f2 := newFakeFIDO2(noHMAC1).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		assertion := &wanlib.CredentialAssertion{
+			Response: protocol.PublicKeyCredentialRequestOptions{
+				Challenge:        []byte{1, 2, 3, 4, 5}, // arbitrary
+				RelyingPartyID:   rpID,
+				UserVerification: protocol.VerificationDiscouraged,
+				Extensions: protocol.AuthenticationExtensions{
+					"prf": map[string]interface{}{"salt1": []byte("0123456789abcdef0123456789abcdef")},
+				},
+			},
+		}
+
+		noHMAC1.SetUP()
+		resp, _, err := wancli.FIDO2Login(ctx, origin, assertion, noHMAC1 /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2Login failed")
+		assert.Empty(t, resp.GetWebauthn().Extensions.HmacGetSecret, "HmacGetSecret unexpectedly returned")
+	})
+
+	t.Run("login rejects salts of the wrong length", func(t *testing.T) {
+		f2 := newFakeFIDO2(hmac1).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		assertion := &wanlib.CredentialAssertion{
+			Response: protocol.PublicKeyCredentialRequestOptions{
+				Challenge:        []byte{1, 2, 3, 4, 5}, // arbitrary
+				RelyingPartyID:   rpID,
+				UserVerification: protocol.VerificationDiscouraged,
+				Extensions: protocol.AuthenticationExtensions{
+					"prf": map[string]interface{}{"salt1": []byte("too-short")},
+				},
+			},
+		}
+
+		hmac1.SetUP()
+		_, _, err := wancli.FIDO2Login(ctx, origin, assertion, hmac1 /* prompt */, nil /* opts */)
+		require.Error(t, err, "FIDO2Login should have rejected an undersized salt")
+	})
+
+	t.Run("login derives a different secret per credential for the same salt", func(t *testing.T) {
+		hmac2 := mustNewFIDO2Device("/hmac2", "supersecrethmac2pin", &libfido2.DeviceInfo{
+			Options:    pinOpts,
+			Extensions: []string{"hmac-secret"},
+		}, &libfido2.Credential{
+			User: libfido2.User{ID: []byte{3, 3, 3}, Name: "vicuna"},
+		})
+
+		salt1 := []byte("0123456789abcdef0123456789abcdef")
+		assertion := &wanlib.CredentialAssertion{
+			Response: protocol.PublicKeyCredentialRequestOptions{
+				Challenge:        []byte{1, 2, 3, 4, 5}, // arbitrary
+				RelyingPartyID:   rpID,
+				UserVerification: protocol.VerificationDiscouraged,
+				Extensions: protocol.AuthenticationExtensions{
+					"prf": map[string]interface{}{"salt1": salt1},
+				},
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		newFakeFIDO2(hmac1).WithNonMeteredLocations().SetCallbacks()
+		hmac1.SetUP()
+		resp1, _, err := wancli.FIDO2Login(ctx, origin, assertion, hmac1 /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2Login failed")
+
+		newFakeFIDO2(hmac2).WithNonMeteredLocations().SetCallbacks()
+		hmac2.SetUP()
+		resp2, _, err := wancli.FIDO2Login(ctx, origin, assertion, hmac2 /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2Login failed")
+
+		assert.NotEqual(t,
+			resp1.GetWebauthn().Extensions.HmacGetSecret,
+			resp2.GetWebauthn().Extensions.HmacGetSecret,
+			"hmac-secret output should differ between credentials for the same salt")
+	})
+}
+
 func TestFIDO2Login_errors(t *testing.T) {
 	resetFIDO2AfterTests(t)
 
 	// Make sure we won't call the real libfido2.
 	f2 := newFakeFIDO2()
-	f2.setCallbacks()
+	f2.SetCallbacks()
 
 	const origin = "https://example.com"
 	okAssertion := &wanlib.CredentialAssertion{
@@ -1207,10 +1601,10 @@ func TestFIDO2Register(t *testing.T) {
 	})
 	// u2f1 is an authenticator that uses fido-u2f attestation.
 	u2f1 := mustNewFIDO2Device("/u2f1", "" /* pin */, &libfido2.DeviceInfo{Options: authOpts})
-	u2f1.format = "fido-u2f"
+	u2f1.Format = "fido-u2f"
 	// none1 is an authenticator that returns no attestation data.
 	none1 := mustNewFIDO2Device("/none1", "" /* pin */, &libfido2.DeviceInfo{Options: authOpts})
-	none1.format = "none"
+	none1.Format = "none"
 
 	challenge, err := protocol.CreateChallenge()
 	require.NoError(t, err, "CreateChallenge failed")
@@ -1256,13 +1650,13 @@ func TestFIDO2Register(t *testing.T) {
 		{
 			name:  "single device, packed attestation",
 			fido2: newFakeFIDO2(auth1),
-			setUP: auth1.setUP,
+			setUP: auth1.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := *baseCC
 				return &cp
 			},
 			assertResponse: func(t *testing.T, ccr *wanpb.CredentialCreationResponse, attObj *protocol.AttestationObject) {
-				assert.Equal(t, auth1.credentialID(), ccr.RawId, "RawId mismatch")
+				assert.Equal(t, auth1.CredentialID(), ccr.RawId, "RawId mismatch")
 
 				// Assert attestation algorithm and signature.
 				require.Equal(t, "packed", attObj.Format, "attestation format mismatch")
@@ -1274,13 +1668,13 @@ func TestFIDO2Register(t *testing.T) {
 				x5c, ok := x5cInterface.([]interface{})
 				require.True(t, ok, "attestation x5c type mismatch (got %T)", x5cInterface)
 				assert.Len(t, x5c, 1, "attestation x5c length mismatch")
-				assert.Equal(t, auth1.cert(), x5c[0], "attestation cert mismatch")
+				assert.Equal(t, auth1.Cert(), x5c[0], "attestation cert mismatch")
 			},
 		},
 		{
 			name:  "fido-u2f attestation",
 			fido2: newFakeFIDO2(u2f1),
-			setUP: u2f1.setUP,
+			setUP: u2f1.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := *baseCC
 				return &cp
@@ -1295,13 +1689,13 @@ func TestFIDO2Register(t *testing.T) {
 				x5c, ok := x5cInterface.([]interface{})
 				require.True(t, ok, "attestation x5c type mismatch (got %T)", x5cInterface)
 				assert.Len(t, x5c, 1, "attestation x5c length mismatch")
-				assert.Equal(t, u2f1.cert(), x5c[0], "attestation cert mismatch")
+				assert.Equal(t, u2f1.Cert(), x5c[0], "attestation cert mismatch")
 			},
 		},
 		{
 			name:  "none attestation",
 			fido2: newFakeFIDO2(none1),
-			setUP: none1.setUP,
+			setUP: none1.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := *baseCC
 				return &cp
@@ -1313,7 +1707,7 @@ func TestFIDO2Register(t *testing.T) {
 		{
 			name:  "pin device",
 			fido2: newFakeFIDO2(pin1),
-			setUP: pin1.setUP,
+			setUP: pin1.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := *baseCC
 				return &cp
@@ -1323,66 +1717,66 @@ func TestFIDO2Register(t *testing.T) {
 		{
 			name:  "multiple valid devices",
 			fido2: newFakeFIDO2(auth1, pin1, pin2, bio1),
-			setUP: bio1.setUP,
+			setUP: bio1.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := *baseCC
 				return &cp
 			},
 			assertResponse: func(t *testing.T, ccr *wanpb.CredentialCreationResponse, attObj *protocol.AttestationObject) {
-				assert.Equal(t, bio1.credentialID(), ccr.RawId, "RawId mismatch (want bio1)")
+				assert.Equal(t, bio1.CredentialID(), ccr.RawId, "RawId mismatch (want bio1)")
 			},
 		},
 		{
 			name:  "multiple devices, uses pin",
 			fido2: newFakeFIDO2(auth1, pin1, pin2, bio1),
-			setUP: pin2.setUP,
+			setUP: pin2.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := *baseCC
 				return &cp
 			},
 			prompt: pin2,
 			assertResponse: func(t *testing.T, ccr *wanpb.CredentialCreationResponse, attObj *protocol.AttestationObject) {
-				assert.Equal(t, pin2.credentialID(), ccr.RawId, "RawId mismatch (want pin2)")
+				assert.Equal(t, pin2.CredentialID(), ccr.RawId, "RawId mismatch (want pin2)")
 			},
 		},
 		{
 			name:  "excluded devices, single valid",
 			fido2: newFakeFIDO2(auth1, bio1),
-			setUP: bio1.setUP,
+			setUP: bio1.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := *baseCC
 				cp.Response.CredentialExcludeList = []protocol.CredentialDescriptor{
 					{
 						Type:         protocol.PublicKeyCredentialType,
-						CredentialID: auth1.credentialID(),
+						CredentialID: auth1.CredentialID(),
 					},
 				}
 				return &cp
 			},
 			assertResponse: func(t *testing.T, ccr *wanpb.CredentialCreationResponse, attObj *protocol.AttestationObject) {
-				assert.Equal(t, bio1.credentialID(), ccr.RawId, "RawId mismatch (want bio1)")
+				assert.Equal(t, bio1.CredentialID(), ccr.RawId, "RawId mismatch (want bio1)")
 			},
 		},
 		{
 			name:  "excluded devices, multiple valid",
 			fido2: newFakeFIDO2(auth1, pin1, pin2, bio1),
-			setUP: bio1.setUP,
+			setUP: bio1.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := *baseCC
 				cp.Response.CredentialExcludeList = []protocol.CredentialDescriptor{
 					{
 						Type:         protocol.PublicKeyCredentialType,
-						CredentialID: pin1.credentialID(),
+						CredentialID: pin1.CredentialID(),
 					},
 					{
 						Type:         protocol.PublicKeyCredentialType,
-						CredentialID: pin2.credentialID(),
+						CredentialID: pin2.CredentialID(),
 					},
 				}
 				return &cp
 			},
 			assertResponse: func(t *testing.T, ccr *wanpb.CredentialCreationResponse, attObj *protocol.AttestationObject) {
-				assert.Equal(t, bio1.credentialID(), ccr.RawId, "RawId mismatch (want bio1)")
+				assert.Equal(t, bio1.CredentialID(), ccr.RawId, "RawId mismatch (want bio1)")
 			},
 		},
 		{
@@ -1399,38 +1793,38 @@ func TestFIDO2Register(t *testing.T) {
 		{
 			name:  "passwordless pin device",
 			fido2: newFakeFIDO2(pin2),
-			setUP: pin2.setUP,
+			setUP: pin2.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := pwdlessCC
 				return &cp
 			},
 			prompt: pin2,
 			assertResponse: func(t *testing.T, ccr *wanpb.CredentialCreationResponse, attObj *protocol.AttestationObject) {
-				require.NotEmpty(t, pin2.credentials, "no resident credentials added to pin2")
-				cred := pin2.credentials[len(pin2.credentials)-1]
+				require.NotEmpty(t, pin2.Credentials, "no resident credentials added to pin2")
+				cred := pin2.Credentials[len(pin2.Credentials)-1]
 				assert.Equal(t, cred.ID, ccr.RawId, "RawId mismatch (want pin2 resident credential)")
 			},
 		},
 		{
 			name:  "passwordless bio device",
 			fido2: newFakeFIDO2(bio1),
-			setUP: bio1.setUP,
+			setUP: bio1.SetUP,
 			createCredential: func() *wanlib.CredentialCreation {
 				cp := pwdlessCC
 				return &cp
 			},
 			prompt: bio1,
 			assertResponse: func(t *testing.T, ccr *wanpb.CredentialCreationResponse, attObj *protocol.AttestationObject) {
-				require.NotEmpty(t, bio1.credentials, "no resident credentials added to bio1")
-				cred := bio1.credentials[len(bio1.credentials)-1]
+				require.NotEmpty(t, bio1.Credentials, "no resident credentials added to bio1")
+				cred := bio1.Credentials[len(bio1.Credentials)-1]
 				assert.Equal(t, cred.ID, ccr.RawId, "RawId mismatch (want bio1 resident credential)")
 			},
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			test.fido2.setCallbacks()
-			test.setUP()
+			test.fido2.SetCallbacks()
+			test.SetUP()
 
 			timeout := test.timeout
 			if timeout == 0 {
@@ -1490,7 +1884,7 @@ func TestFIDO2Register_errors(t *testing.T) {
 
 	// Make sure we won't call the real libfido2.
 	f2 := newFakeFIDO2()
-	f2.setCallbacks()
+	f2.SetCallbacks()
 
 	const origin = "https://example.com"
 	okCC := &wanlib.CredentialCreation{
@@ -1649,437 +2043,598 @@ func TestFIDO2Register_errors(t *testing.T) {
 	}
 }
 
-func resetFIDO2AfterTests(t *testing.T) {
-	pollInterval := wancli.FIDO2PollInterval
-	devLocations := wancli.FIDODeviceLocations
-	newDevice := wancli.FIDONewDevice
-	t.Cleanup(func() {
-		wancli.FIDO2PollInterval = pollInterval
-		wancli.FIDODeviceLocations = devLocations
-		wancli.FIDONewDevice = newDevice
+func TestFIDO2CredentialManagement(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
+
+	const llamaName = "llama"
+	const alpacaName = "alpaca"
+	llamaID := []byte{1, 1, 1, 1, 1}
+	alpacaID := []byte{1, 1, 1, 1, 2}
+
+	// pin3 is a PIN authenticator with a single resident credential.
+	pin3 := mustNewFIDO2Device("/pin3", "supersecretpin3", &libfido2.DeviceInfo{
+		Options: pinOpts,
+	}, &libfido2.Credential{
+		User: libfido2.User{ID: alpacaID, Name: alpacaName},
+	})
+	// bio2 is a biometric authenticator with two resident credentials.
+	bio2 := mustNewFIDO2Device("/bio2", "supersecretBIO2pin", &libfido2.DeviceInfo{
+		Options: bioOpts,
+	}, &libfido2.Credential{
+		User: libfido2.User{ID: llamaID, Name: llamaName},
+	}, &libfido2.Credential{
+		User: libfido2.User{ID: alpacaID, Name: alpacaName},
 	})
-}
 
-type fakeFIDO2 struct {
-	useNonMeteredLocs bool
+	t.Run("list", func(t *testing.T) {
+		f2 := newFakeFIDO2(bio2).WithNonMeteredLocations()
+		f2.SetCallbacks()
 
-	locs    []*libfido2.DeviceLocation
-	devices map[string]*fakeFIDO2Device
-}
+		bio2.SetUP()
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-func newFakeFIDO2(devs ...*fakeFIDO2Device) *fakeFIDO2 {
-	f := &fakeFIDO2{
-		devices: make(map[string]*fakeFIDO2Device),
-	}
-	for _, dev := range devs {
-		if _, ok := f.devices[dev.path]; ok {
-			panic(fmt.Sprintf("Duplicate device path registered: %q", dev.path))
+		creds, err := wancli.FIDO2CredentialManagement(ctx, bio2 /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2CredentialManagement failed")
+		require.Len(t, creds, 2, "unexpected number of credentials")
+
+		gotNames := map[string]bool{}
+		for _, cred := range creds {
+			gotNames[cred.User.Name] = true
+			assert.Equal(t, wanclitest.DefaultRPID, cred.RP.ID, "RP mismatch")
 		}
-		f.locs = append(f.locs, &libfido2.DeviceLocation{
-			Path: dev.path,
+		assert.True(t, gotNames[llamaName], "missing %q credential", llamaName)
+		assert.True(t, gotNames[alpacaName], "missing %q credential", alpacaName)
+	})
+
+	t.Run("list across multiple RPs", func(t *testing.T) {
+		const otherRPID = "other.example.com"
+
+		multiRP := mustNewFIDO2Device("/multirp", "supersecretmultirppin", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		})
+		multiRP.AddResidentCredentialForRP(wanclitest.DefaultRPID, &libfido2.Credential{
+			User: libfido2.User{ID: llamaID, Name: llamaName},
+		})
+		multiRP.AddResidentCredentialForRP(otherRPID, &libfido2.Credential{
+			User: libfido2.User{ID: alpacaID, Name: alpacaName},
 		})
-		f.devices[dev.path] = dev
-	}
-	return f
-}
 
-// withNonMeteredLocations makes fakeFIDO2 return all known devices immediately.
-// Useful to test flows that optimize for plugged devices.
-func (f *fakeFIDO2) withNonMeteredLocations() *fakeFIDO2 {
-	f.useNonMeteredLocs = true
-	return f
-}
+		f2 := newFakeFIDO2(multiRP).WithNonMeteredLocations()
+		f2.SetCallbacks()
 
-func (f *fakeFIDO2) setCallbacks() {
-	if f.useNonMeteredLocs {
-		*wancli.FIDODeviceLocations = f.DeviceLocations
-	} else {
-		*wancli.FIDODeviceLocations = f.newMeteredDeviceLocations()
-	}
-	*wancli.FIDONewDevice = f.NewDevice
-}
+		multiRP.SetUP()
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-func (f *fakeFIDO2) newMeteredDeviceLocations() func() ([]*libfido2.DeviceLocation, error) {
-	i := 0
-	return func() ([]*libfido2.DeviceLocation, error) {
-		// Delay showing devices for a while to exercise polling.
-		i++
-		const minLoops = 2
-		if i < minLoops {
-			return nil, nil
+		creds, err := wancli.FIDO2CredentialManagement(ctx, multiRP /* prompt */, nil /* opts */)
+		require.NoError(t, err, "FIDO2CredentialManagement failed")
+		require.Len(t, creds, 2, "unexpected number of credentials")
+
+		gotRPs := map[string]string{}
+		for _, cred := range creds {
+			gotRPs[cred.User.Name] = cred.RP.ID
 		}
-		return f.locs, nil
-	}
-}
+		assert.Equal(t, wanclitest.DefaultRPID, gotRPs[llamaName], "RP mismatch for %q", llamaName)
+		assert.Equal(t, otherRPID, gotRPs[alpacaName], "RP mismatch for %q", alpacaName)
+	})
 
-func (f *fakeFIDO2) DeviceLocations() ([]*libfido2.DeviceLocation, error) {
-	return f.locs, nil
-}
+	t.Run("requires the correct pin", func(t *testing.T) {
+		f2 := newFakeFIDO2(pin3).WithNonMeteredLocations()
+		f2.SetCallbacks()
 
-func (f *fakeFIDO2) NewDevice(path string) (wancli.FIDODevice, error) {
-	if dev, ok := f.devices[path]; ok {
-		return dev, nil
-	}
-	// go-libfido2 doesn't actually error here, but we do for simplicity.
-	return nil, errors.New("not found")
-}
+		pin3.SetUP()
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-type fakeFIDO2Device struct {
-	simplePicker
+		_, err := wancli.FIDO2CredentialManagement(ctx, &fixedPINPrompt{pin: "wrongpin"}, nil /* opts */)
+		assert.ErrorIs(t, err, libfido2.ErrPinInvalid, "FIDO2CredentialManagement should have rejected an incorrect PIN")
+	})
 
-	// Set to true to cause "unsupported option" UV errors, regardless of other
-	// conditions.
-	failUV bool
+	t.Run("delete removes the credential from future assertions", func(t *testing.T) {
+		// pin4 is a standalone device for this subtest, since the "delete" and
+		// "update user" subtests below also mutate pin3's credential set.
+		pin4 := mustNewFIDO2Device("/pin4", "supersecretpin4", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		}, &libfido2.Credential{
+			User: libfido2.User{ID: alpacaID, Name: alpacaName},
+		})
+
+		f2 := newFakeFIDO2(pin4).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		pin4.SetUP()
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-	// Set to true to simulate an U2F-only device.
-	// Causes libfido2.ErrNotFIDO2 on Info.
-	u2fOnly bool
+		require.Len(t, pin4.Credentials, 1, "sanity check failed")
+		credID := pin4.Credentials[0].ID
+
+		err := wancli.FIDO2DeleteCredential(ctx, credID, pin4 /* prompt */)
+		require.NoError(t, err, "FIDO2DeleteCredential failed")
+
+		assertion := &wanlib.CredentialAssertion{
+			Response: protocol.PublicKeyCredentialRequestOptions{
+				Challenge:        []byte{1, 2, 3, 4, 5}, // arbitrary
+				RelyingPartyID:   wanclitest.DefaultRPID,
+				UserVerification: protocol.VerificationDiscouraged,
+			},
+		}
+		pin4.SetUP()
+		_, _, err = wancli.FIDO2Login(ctx, "https://"+wanclitest.DefaultRPID, assertion, pin4 /* prompt */, nil /* opts */)
+		assert.ErrorIs(t, err, wancli.ErrUsingNonRegisteredDevice, "deleted credential unexpectedly still satisfies login")
+	})
 
-	// assertionErrors is a chain of errors to return from Assertion.
-	// Errors are returned from start to end and removed, one-by-one, on each
-	// invocation of the Assertion method.
-	// If the slice is empty, Assertion runs normally.
-	assertionErrors []error
+	t.Run("delete", func(t *testing.T) {
+		f2 := newFakeFIDO2(pin3).WithNonMeteredLocations()
+		f2.SetCallbacks()
 
-	path        string
-	info        *libfido2.DeviceInfo
-	pin         string
-	credentials []*libfido2.Credential
+		pin3.SetUP()
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-	// wantRPID may be set directly to enable RPID checks on Assertion.
-	wantRPID string
-	// format may be set directly to change the attestation format.
-	format string
+		require.Len(t, pin3.Credentials, 1, "sanity check failed")
+		credID := pin3.Credentials[0].ID
 
-	key    *mocku2f.Key
-	pubKey []byte
+		err := wancli.FIDO2DeleteCredential(ctx, credID, pin3 /* prompt */)
+		require.NoError(t, err, "FIDO2DeleteCredential failed")
+		assert.Empty(t, pin3.Credentials, "credential not deleted")
+	})
 
-	// cond guards up and cancel.
-	cond       *sync.Cond
-	up, cancel bool
+	t.Run("update user", func(t *testing.T) {
+		f2 := newFakeFIDO2(pin3).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		pin3.SetUP()
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		require.Len(t, pin3.Credentials, 1, "sanity check failed")
+		credID := pin3.Credentials[0].ID
+
+		const newName = "alpaca2"
+		const newDisplayName = "Alpaca Two"
+		err := wancli.FIDO2UpdateCredentialUser(ctx, credID, libfido2.User{
+			ID:          alpacaID,
+			Name:        newName,
+			DisplayName: newDisplayName,
+		}, pin3 /* prompt */)
+		require.NoError(t, err, "FIDO2UpdateCredentialUser failed")
+
+		require.Len(t, pin3.Credentials, 1, "credential unexpectedly added/removed")
+		assert.Equal(t, newName, pin3.Credentials[0].User.Name, "user name not updated")
+		assert.Equal(t, newDisplayName, pin3.Credentials[0].User.DisplayName, "user display name not updated")
+	})
 }
 
-func mustNewFIDO2Device(path, pin string, info *libfido2.DeviceInfo, creds ...*libfido2.Credential) *fakeFIDO2Device {
-	dev, err := newFIDO2Device(path, pin, info, creds...)
-	if err != nil {
-		panic(err)
-	}
-	return dev
+func TestFIDO2BioEnrollment(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
+
+	bio1 := mustNewFIDO2Device("/bio1", "supersecretBIOpin", &libfido2.DeviceInfo{
+		Options: bioOpts,
+	})
+
+	f2 := newFakeFIDO2(bio1).WithNonMeteredLocations()
+	f2.SetCallbacks()
+	bio1.SetUP()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	enrollment, err := wancli.NewFIDO2BioEnrollment(ctx, bio1 /* prompt */)
+	require.NoError(t, err, "NewFIDO2BioEnrollment failed")
+
+	info, err := enrollment.SensorInfo()
+	require.NoError(t, err, "SensorInfo failed")
+	assert.Equal(t, bio1.BioMaxSamples, info.MaxSamples, "MaxSamples mismatch")
+
+	templateID, err := enrollment.EnrollBegin(bio1 /* prompt */)
+	require.NoError(t, err, "EnrollBegin failed")
+	assert.Zero(t, bio1.BioRemainingSamples, "enrollment should be complete")
+	assert.Equal(t, bio1.BioMaxSamples, bio1.BioSamplesCaptured, "unexpected sample count")
+
+	const friendlyName = "right thumb"
+	require.NoError(t, enrollment.SetTemplateName(templateID, friendlyName), "SetTemplateName failed")
+
+	templates, err := enrollment.EnumerateTemplates()
+	require.NoError(t, err, "EnumerateTemplates failed")
+	require.Len(t, templates, 1, "unexpected template count")
+	assert.Equal(t, friendlyName, templates[0].FriendlyName, "FriendlyName mismatch")
+
+	require.NoError(t, enrollment.RemoveTemplate(templateID), "RemoveTemplate failed")
+	templates, err = enrollment.EnumerateTemplates()
+	require.NoError(t, err, "EnumerateTemplates after removal failed")
+	assert.Empty(t, templates, "template not removed")
+
+	t.Run("cancellation mid-enrollment reports ErrKeepaliveCancel", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/bio2", "supersecretbio2pin", &libfido2.DeviceInfo{
+			Options: bioOpts,
+		})
+
+		tmplID, err := dev.BioEnroll(dev.PIN)
+		require.NoError(t, err, "BioEnroll failed")
+
+		_, err = dev.BioEnrollContinue(dev.PIN, tmplID)
+		require.NoError(t, err, "BioEnrollContinue failed")
+		require.Greater(t, dev.BioRemainingSamples, 0, "sanity check: enrollment should not be complete yet")
+
+		require.NoError(t, dev.BioEnrollCancel(), "BioEnrollCancel failed")
+
+		_, err = dev.BioEnrollContinue(dev.PIN, tmplID)
+		assert.ErrorIs(t, err, libfido2.ErrKeepaliveCancel, "BioEnrollContinue should report the cancellation")
+	})
+
+	t.Run("rejected on PIN-only devices", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/pinonly-bio", "supersecretpinonlypin", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		})
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+		dev.SetUP()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		_, err := wancli.NewFIDO2BioEnrollment(ctx, dev /* prompt */)
+		assert.Error(t, err, "NewFIDO2BioEnrollment should have rejected a PIN-only device")
+	})
 }
 
-func newFIDO2Device(path, pin string, info *libfido2.DeviceInfo, creds ...*libfido2.Credential) (*fakeFIDO2Device, error) {
-	key, err := mocku2f.Create()
-	if err != nil {
-		return nil, err
-	}
+func TestFIDO2Reset(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
 
-	pubKeyCBOR, err := wanlib.U2FKeyToCBOR(&key.PrivateKey.PublicKey)
-	if err != nil {
-		return nil, err
-	}
+	for _, test := range []struct {
+		name    string
+		dev     *fakeFIDO2Device
+		wantErr error
+	}{
+		{
+			name: "ok",
+			dev: mustNewFIDO2Device("/reset1", "supersecretpin", &libfido2.DeviceInfo{
+				Options: pinOpts,
+			}, &libfido2.Credential{
+				User: libfido2.User{ID: []byte{1, 2, 3}, Name: "llama"},
+			}),
+		},
+		{
+			name: "reset window exceeded",
+			dev: func() *fakeFIDO2Device {
+				dev := mustNewFIDO2Device("/reset2", "supersecretpin", &libfido2.DeviceInfo{
+					Options: pinOpts,
+				})
+				dev.ResetWindowExceeded = true
+				return dev
+			}(),
+			wantErr: wancli.ErrResetWindowExceeded,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f2 := newFakeFIDO2(test.dev).WithNonMeteredLocations()
+			f2.SetCallbacks()
+			test.dev.SetUP()
 
-	for _, cred := range creds {
-		cred.ID = make([]byte, 16) // somewhat arbitrary
-		if _, err := rand.Read(cred.ID); err != nil {
-			return nil, err
-		}
-		cred.Type = libfido2.ES256
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+
+			err := wancli.FIDO2Reset(ctx, test.dev.Path(), test.dev /* prompt */)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr, "FIDO2Reset error mismatch")
+				return
+			}
+			require.NoError(t, err, "FIDO2Reset failed")
+			assert.Empty(t, test.dev.Credentials, "credentials not wiped")
+			assert.Empty(t, test.dev.PIN, "PIN not wiped")
+			assert.False(t, test.dev.HasClientPIN(), "clientPin option not cleared")
+		})
 	}
 
-	return &fakeFIDO2Device{
-		path:        path,
-		pin:         pin,
-		credentials: creds,
-		format:      "packed",
-		info:        info,
-		key:         key,
-		pubKey:      pubKeyCBOR,
-		cond:        sync.NewCond(&sync.Mutex{}),
-	}, nil
-}
+	t.Run("multiple devices plugged in only reset the explicit device path", func(t *testing.T) {
+		// target is the device the caller explicitly asked to reset.
+		target := mustNewFIDO2Device("/reset-target", "supersecretpin", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		}, &libfido2.Credential{
+			User: libfido2.User{ID: []byte{1, 2, 3}, Name: "llama"},
+		})
+		// other is an unrelated device plugged in at the same time. Since
+		// FIDO2Reset never auto-selects a device (see its doc comment), other
+		// should be left completely untouched.
+		other := mustNewFIDO2Device("/reset-other", "supersecretotherpin", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		}, &libfido2.Credential{
+			User: libfido2.User{ID: []byte{4, 5, 6}, Name: "alpaca"},
+		})
 
-func (f *fakeFIDO2Device) PromptPIN() (string, error) {
-	return f.pin, nil
-}
+		newFakeFIDO2(target, other).WithNonMeteredLocations().SetCallbacks()
+		target.SetUP()
 
-func (f *fakeFIDO2Device) PromptTouch() error {
-	f.setUP()
-	return nil
-}
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-func (f *fakeFIDO2Device) credentialID() []byte {
-	return f.key.KeyHandle
-}
+		require.NoError(t, wancli.FIDO2Reset(ctx, target.Path(), target /* prompt */), "FIDO2Reset failed")
+		assert.Empty(t, target.Credentials, "target credentials not wiped")
 
-func (f *fakeFIDO2Device) cert() []byte {
-	return f.key.Cert
+		assert.Len(t, other.Credentials, 1, "other device was unexpectedly reset")
+		assert.Equal(t, "supersecretotherpin", other.PIN, "other device's PIN was unexpectedly wiped")
+		assert.False(t, other.Canceled(), "other device should never have been touched")
+	})
 }
 
-func (f *fakeFIDO2Device) Info() (*libfido2.DeviceInfo, error) {
-	if f.u2fOnly {
-		return nil, libfido2.ErrNotFIDO2
-	}
-	return f.info, nil
+// fakePINChangePrompt adapts a fakeFIDO2Device into a wancli.PINChangePrompt,
+// supplying canned old/new PINs.
+type fakePINChangePrompt struct {
+	*fakeFIDO2Device
+	oldPIN, newPIN string
 }
 
-func (f *fakeFIDO2Device) setUP() {
-	f.cond.L.Lock()
-	f.up = true
-	f.cond.L.Unlock()
-	f.cond.Broadcast()
+func (p fakePINChangePrompt) PromptOldPIN() (string, error) {
+	return p.oldPIN, nil
 }
 
-func (f *fakeFIDO2Device) Cancel() error {
-	f.cond.L.Lock()
-	f.cancel = true
-	f.cond.L.Unlock()
-	f.cond.Broadcast()
-	return nil
+func (p fakePINChangePrompt) PromptNewPIN() (string, error) {
+	return p.newPIN, nil
 }
 
-func (f *fakeFIDO2Device) MakeCredential(
-	clientDataHash []byte,
-	rp libfido2.RelyingParty,
-	user libfido2.User,
-	typ libfido2.CredentialType,
-	pin string,
-	opts *libfido2.MakeCredentialOpts,
-) (*libfido2.Attestation, error) {
-	switch {
-	case len(clientDataHash) == 0:
-		return nil, errors.New("clientDataHash required")
-	case rp.ID == "":
-		return nil, errors.New("rp.ID required")
-	case typ != libfido2.ES256:
-		return nil, errors.New("bad credential type")
-	case opts.UV == libfido2.False: // can only be empty or true
-		return nil, libfido2.ErrUnsupportedOption
-	case opts.UV == libfido2.True && !f.hasUV():
-		return nil, libfido2.ErrUnsupportedOption // PIN authenticators don't like UV
-	case opts.RK == libfido2.True && !f.hasRK():
-		// TODO(codingllama): Confirm scenario with a real authenticator.
-		return nil, libfido2.ErrUnsupportedOption
-	}
+func TestFIDO2PIN(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
 
-	// Validate PIN regardless of opts.
-	// This is in line with how current YubiKeys behave.
-	if err := f.validatePIN(pin); err != nil {
-		return nil, err
-	}
+	t.Run("set", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/pinset1", "" /* pin */, &libfido2.DeviceInfo{
+			Options: authOpts,
+		})
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+		dev.SetUP()
+		dev.PIN = "newpin123" // PromptPIN answer, device has no PIN yet.
 
-	if err := f.maybeLockUntilInteraction(true /* up */); err != nil {
-		return nil, err
-	}
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-	cert, sig := f.cert(), makeCredentialSig
-	if f.format == "none" {
-		// Do not return attestation data in case of "none".
-		// This is a hypothetical scenario, as I haven't seen device that does this.
-		cert, sig = nil, nil
-	}
+		require.NoError(t, wancli.FIDO2SetPIN(ctx, dev /* prompt */), "FIDO2SetPIN failed")
+		assert.True(t, dev.HasClientPIN(), "clientPin option not set")
+		assert.Equal(t, "newpin123", dev.PIN, "PIN mismatch")
+	})
 
-	// Did we create a resident credential? Create a new ID for it and record it.
-	cID := f.key.KeyHandle
-	if opts.RK == libfido2.True {
-		cID = make([]byte, 16) // somewhat arbitrary
-		if _, err := rand.Read(cID); err != nil {
-			return nil, err
-		}
-		f.credentials = append(f.credentials, &libfido2.Credential{
-			ID:   cID,
-			Type: libfido2.ES256,
-			User: user,
+	t.Run("set fails if PIN already configured", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/pinset2", "supersecretpin", &libfido2.DeviceInfo{
+			Options: pinOpts,
 		})
-	}
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+		dev.SetUP()
 
-	return &libfido2.Attestation{
-		ClientDataHash: clientDataHash,
-		AuthData:       makeCredentialAuthDataCBOR,
-		CredentialID:   cID,
-		CredentialType: libfido2.ES256,
-		PubKey:         f.pubKey,
-		Cert:           cert,
-		Sig:            sig,
-		Format:         f.format,
-	}, nil
-}
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-func (f *fakeFIDO2Device) Assertion(
-	rpID string,
-	clientDataHash []byte,
-	credentialIDs [][]byte,
-	pin string,
-	opts *libfido2.AssertionOpts,
-) ([]*libfido2.Assertion, error) {
-	// Give preference to simulated errors.
-	if len(f.assertionErrors) > 0 {
-		err := f.assertionErrors[0]
-		f.assertionErrors = f.assertionErrors[1:]
-		return nil, err
-	}
+		err := wancli.FIDO2SetPIN(ctx, dev /* prompt */)
+		assert.Error(t, err, "FIDO2SetPIN should have failed, PIN already configured")
+	})
 
-	switch {
-	case rpID == "":
-		return nil, errors.New("rp.ID required")
-	case f.wantRPID != "" && f.wantRPID != rpID:
-		return nil, libfido2.ErrNoCredentials
-	case len(clientDataHash) == 0:
-		return nil, errors.New("clientDataHash required")
-	}
+	t.Run("change", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/pinchange1", "supersecretpin", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		})
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+		dev.SetUP()
 
-	// Validate UV.
-	switch {
-	case opts.UV == "": // OK, actually works as false.
-	case opts.UV == libfido2.True && f.failUV:
-		// Emulate UV failures, as seen in some devices regardless of other
-		// settings.
-		return nil, libfido2.ErrUnsupportedOption
-	case opts.UV == libfido2.True && f.isBio(): // OK.
-	case opts.UV == libfido2.True && f.hasClientPin() && pin != "": // OK, doubles as UV.
-	default: // Anything else is invalid, including libfido2.False.
-		return nil, libfido2.ErrUnsupportedOption
-	}
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-	// Validate PIN only if present and UP is required.
-	// This is in line with how current YubiKeys behave.
-	// TODO(codingllama): This should probably take UV into consideration.
-	privilegedAccess := f.isBio()
-	if pin != "" && opts.UP == libfido2.True {
-		if err := f.validatePIN(pin); err != nil {
-			return nil, err
-		}
-		privilegedAccess = true
-	}
+		prompt := fakePINChangePrompt{fakeFIDO2Device: dev, oldPIN: "supersecretpin", newPIN: "evennewerpin"}
+		require.NoError(t, wancli.FIDO2ChangePIN(ctx, prompt), "FIDO2ChangePIN failed")
+		assert.Equal(t, "evennewerpin", dev.PIN, "PIN mismatch")
+	})
 
-	// Block for user presence before accessing any credential data.
-	if err := f.maybeLockUntilInteraction(opts.UP == libfido2.True); err != nil {
-		return nil, err
-	}
+	t.Run("change fails with wrong old PIN", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/pinchange2", "supersecretpin", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		})
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+		dev.SetUP()
 
-	// Index credentialIDs for easier use.
-	credIDs := make(map[string]struct{})
-	for _, cred := range credentialIDs {
-		credIDs[string(cred)] = struct{}{}
-	}
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-	// Assemble one assertion for each allowed credential we hold.
-	var assertions []*libfido2.Assertion
-
-	// "base" credential. Only add an assertion if explicitly requested.
-	if _, ok := credIDs[string(f.key.KeyHandle)]; ok {
-		assertions = append(assertions, &libfido2.Assertion{
-			AuthDataCBOR: assertionAuthDataCBOR,
-			Sig:          assertionSig,
-			CredentialID: f.key.KeyHandle,
-			User:         libfido2.User{
-				// We don't hold data about the user for the "base" credential / MFA
-				// scenario.
-				// A typical authenticator might choose to save some data within the
-				// key handle itself.
-			},
+		prompt := fakePINChangePrompt{fakeFIDO2Device: dev, oldPIN: "wrongpin", newPIN: "evennewerpin"}
+		err := wancli.FIDO2ChangePIN(ctx, prompt)
+		assert.Error(t, err, "FIDO2ChangePIN should have failed, wrong old PIN")
+		assert.Equal(t, "supersecretpin", dev.PIN, "PIN should not have changed")
+	})
+
+	t.Run("set rejects PIN outside CTAP2 length bounds", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/pinset3", "" /* pin */, &libfido2.DeviceInfo{
+			Options: authOpts,
 		})
-	}
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+		dev.SetUP()
 
-	// Resident credentials.
-	if privilegedAccess {
-		for _, resident := range f.credentials {
-			allowed := len(credIDs) == 0
-			if !allowed {
-				_, allowed = credIDs[string(resident.ID)]
-			}
-			if !allowed {
-				continue
-			}
-			assertions = append(assertions, &libfido2.Assertion{
-				AuthDataCBOR: assertionAuthDataCBOR,
-				Sig:          assertionSig,
-				HMACSecret:   []byte{},
-				CredentialID: resident.ID,
-				User: libfido2.User{
-					ID:          resident.User.ID,
-					Name:        resident.User.Name,
-					DisplayName: resident.User.DisplayName,
-					Icon:        resident.User.Icon,
-				},
-			})
-		}
-	}
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-	switch len(assertions) {
-	case 0:
-		return nil, libfido2.ErrNoCredentials
-	case 1:
-		// Remove user name / display name / icon.
-		// See the authenticatorGetAssertion response structure, user member (0x04):
-		// https://fidoalliance.org/specs/fido-v2.1-ps-20210615/fido-client-to-authenticator-protocol-v2.1-ps-20210615.html#authenticatorgetassertion-response-structure
-		assertions[0].User.Name = ""
-		assertions[0].User.DisplayName = ""
-		assertions[0].User.Icon = ""
-		return assertions, nil
-	default:
-		return assertions, nil
-	}
-}
+		dev.PIN = "123" // too short
+		err := wancli.FIDO2SetPIN(ctx, dev /* prompt */)
+		assert.ErrorContains(t, err, "too short", "FIDO2SetPIN should have rejected a too-short PIN")
+		assert.False(t, dev.HasClientPIN(), "clientPin option should not have been set")
+	})
 
-func (f *fakeFIDO2Device) validatePIN(pin string) error {
-	switch {
-	case f.isBio() && pin == "": // OK, biometric check supersedes PIN.
-	case f.pin != "" && pin == "":
-		return libfido2.ErrPinRequired
-	case f.pin != "" && f.pin != pin:
-		return libfido2.ErrPinInvalid
-	}
-	return nil
-}
+	t.Run("change surfaces a blocked PIN distinctly", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/pinchange3", "supersecretpin", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		})
+		dev.PINBlocked = true
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+		dev.SetUP()
 
-func (f *fakeFIDO2Device) hasClientPin() bool {
-	return f.hasBoolOpt("clientPin")
-}
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
 
-func (f *fakeFIDO2Device) hasRK() bool {
-	return f.hasBoolOpt("rk")
-}
+		prompt := fakePINChangePrompt{fakeFIDO2Device: dev, oldPIN: "supersecretpin", newPIN: "evennewerpin"}
+		err := wancli.FIDO2ChangePIN(ctx, prompt)
+		require.ErrorIs(t, err, wancli.ErrPINBlocked, "FIDO2ChangePIN error mismatch")
+	})
+
+	t.Run("change surfaces a blocked PIN auth distinctly", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/pinchange4", "supersecretpin", &libfido2.DeviceInfo{
+			Options: pinOpts,
+		})
+		dev.PINAuthBlocked = true
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+		dev.SetUP()
 
-func (f *fakeFIDO2Device) hasUV() bool {
-	return f.hasBoolOpt("uv")
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		prompt := fakePINChangePrompt{fakeFIDO2Device: dev, oldPIN: "supersecretpin", newPIN: "evennewerpin"}
+		err := wancli.FIDO2ChangePIN(ctx, prompt)
+		require.ErrorIs(t, err, wancli.ErrPINAuthBlocked, "FIDO2ChangePIN error mismatch")
+	})
 }
 
-func (f *fakeFIDO2Device) isBio() bool {
-	return f.hasBoolOpt("bioEnroll")
+func TestFIDO2SelectDevice(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
+
+	dev1 := mustNewFIDO2Device("/dev1", "" /* pin */, &libfido2.DeviceInfo{Options: authOpts})
+	dev2 := mustNewFIDO2Device("/dev2", "" /* pin */, &libfido2.DeviceInfo{Options: authOpts})
+
+	f2 := newFakeFIDO2(dev1, dev2).WithNonMeteredLocations()
+	f2.SetCallbacks()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		dev2.SetUP() // user touches dev2, dev1 should lose the race.
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	chosen, _, err := wancli.FIDO2SelectDevice(ctx, noopPrompt{})
+	require.NoError(t, err, "FIDO2SelectDevice failed")
+	assert.Same(t, wancli.FIDODevice(dev2), chosen, "FIDO2SelectDevice picked the wrong device")
+
+	// dev1 should have been canceled rather than left hanging.
+	assert.True(t, dev1.Canceled(), "dev1 was not canceled")
 }
 
-func (f *fakeFIDO2Device) hasBoolOpt(name string) bool {
-	if f.info == nil {
-		return false
-	}
+// TestFIDO2SelectDevice_CTAP21 exercises the native authenticatorSelection
+// path, taken instead of the CTAP2.0 dummy-MakeCredential probe when a
+// device advertises CTAP2.1 support.
+func TestFIDO2SelectDevice_CTAP21(t *testing.T) {
+	resetFIDO2AfterTests(t)
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
 
-	for _, opt := range f.info.Options {
-		if opt.Name == name {
-			return opt.Value == libfido2.True
-		}
+	ctap21Info := &libfido2.DeviceInfo{
+		Versions: []string{"FIDO_2_0", "FIDO_2_1"},
+		Options:  authOpts,
 	}
-	return false
+
+	t.Run("winner is selected and losers are canceled", func(t *testing.T) {
+		dev1 := mustNewFIDO2Device("/dev1", "" /* pin */, ctap21Info)
+		dev2 := mustNewFIDO2Device("/dev2", "" /* pin */, ctap21Info)
+
+		f2 := newFakeFIDO2(dev1, dev2).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			dev2.SetUP() // user touches dev2, dev1 should lose the race.
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		chosen, _, err := wancli.FIDO2SelectDevice(ctx, noopPrompt{})
+		require.NoError(t, err, "FIDO2SelectDevice failed")
+		assert.Same(t, wancli.FIDODevice(dev2), chosen, "FIDO2SelectDevice picked the wrong device")
+
+		// dev1 should have been canceled via the native Selection command,
+		// rather than left hanging.
+		assert.True(t, dev1.Canceled(), "dev1 was not canceled")
+	})
+
+	t.Run("SelectionDelay lets the faster device win deterministically", func(t *testing.T) {
+		slow := mustNewFIDO2Device("/slow", "" /* pin */, ctap21Info)
+		slow.SelectionDelay = 50 * time.Millisecond
+		fast := mustNewFIDO2Device("/fast", "" /* pin */, ctap21Info)
+
+		f2 := newFakeFIDO2(slow, fast).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		slow.SetUP()
+		fast.SetUP()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		chosen, _, err := wancli.FIDO2SelectDevice(ctx, noopPrompt{})
+		require.NoError(t, err, "FIDO2SelectDevice failed")
+		assert.Same(t, wancli.FIDODevice(fast), chosen, "FIDO2SelectDevice picked the wrong device")
+		assert.True(t, slow.Canceled(), "slow was not canceled")
+	})
+
+	t.Run("SelectionErrors propagate", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/dev", "" /* pin */, ctap21Info)
+		wantErr := errors.New("selection blew up")
+		dev.SelectionErrors = []error{wantErr}
+		// A second, untouched device keeps this above the single-device fast
+		// path, so Selection() is actually exercised on dev.
+		other := mustNewFIDO2Device("/other", "" /* pin */, ctap21Info)
+
+		f2 := newFakeFIDO2(dev, other).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		_, _, err := wancli.FIDO2SelectDevice(ctx, noopPrompt{})
+		require.ErrorIs(t, err, wantErr, "FIDO2SelectDevice error mismatch")
+	})
+
+	t.Run("single device resolves without a redundant selection round-trip", func(t *testing.T) {
+		dev := mustNewFIDO2Device("/dev", "" /* pin */, ctap21Info)
+
+		f2 := newFakeFIDO2(dev).WithNonMeteredLocations()
+		f2.SetCallbacks()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+
+		chosen, _, err := wancli.FIDO2SelectDevice(ctx, noopPrompt{})
+		require.NoError(t, err, "FIDO2SelectDevice failed")
+		assert.Same(t, wancli.FIDODevice(dev), chosen, "FIDO2SelectDevice picked the wrong device")
+		assert.Equal(t, 0, dev.SelectionCalls, "Selection should be skipped entirely for a single device")
+	})
 }
 
-func (f *fakeFIDO2Device) maybeLockUntilInteraction(up bool) error {
-	if !up {
-		return nil // without UserPresence it doesn't lock.
-	}
+func resetFIDO2AfterTests(t *testing.T) {
+	pollInterval := wancli.FIDO2PollInterval
+	devLocations := wancli.FIDODeviceLocations
+	newDevice := wancli.FIDONewDevice
+	t.Cleanup(func() {
+		wancli.FIDO2PollInterval = pollInterval
+		wancli.FIDODeviceLocations = devLocations
+		wancli.FIDONewDevice = newDevice
+	})
+}
 
-	// Lock until we get a touch or a cancel.
-	f.cond.L.Lock()
-	for !f.up && !f.cancel {
-		f.cond.Wait()
-	}
-	defer f.cond.L.Unlock()
+// fakeFIDO2 and fakeFIDO2Device alias the public wanclitest helpers, so the
+// bulk of this file (which predates wanclitest) doesn't need touching.
+type fakeFIDO2 = wanclitest.VirtualHub
 
-	// Record/reset state.
-	isCancel := f.cancel
-	f.up = false
-	f.cancel = false
+type fakeFIDO2Device = wanclitest.VirtualDevice
 
-	if isCancel {
-		return libfido2.ErrKeepaliveCancel
-	}
-	return nil
+func newFakeFIDO2(devs ...*fakeFIDO2Device) *fakeFIDO2 {
+	return wanclitest.NewVirtualHub(devs...)
+}
+
+func mustNewFIDO2Device(path, pin string, info *libfido2.DeviceInfo, creds ...*libfido2.Credential) *fakeFIDO2Device {
+	return wanclitest.NewVirtualDevice(path, pin, info, creds...)
 }
@@ -0,0 +1,926 @@
+//go:build libfido2
+// +build libfido2
+
+// Copyright 2022 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wanclitest provides a virtual/software FIDO2 authenticator,
+// exercising the same device-facing surface as wancli (FIDO2Login,
+// FIDO2Register, credential management, bio enrollment, reset and PIN
+// management), so downstream consumers of wancli can unit test their own
+// code against it without real hardware.
+package wanclitest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/keys-pub/go-libfido2"
+
+	"github.com/gravitational/teleport/lib/auth/mocku2f"
+	wanlib "github.com/gravitational/teleport/lib/auth/webauthn"
+	wancli "github.com/gravitational/teleport/lib/auth/webauthncli"
+)
+
+// DefaultRPID is the default RPID assigned to resident credentials added via
+// AddResidentCredential or NewVirtualDevice. Use AddResidentCredentialForRP
+// to register a credential under a different RP.
+const DefaultRPID = "example.com"
+
+var makeCredentialAuthDataCBOR, makeCredentialSig []byte
+var assertionAuthDataCBOR, assertionSig []byte
+
+func init() {
+	// Initialize arrays with random data, but use realistic sizes.
+	// YMMV.
+	makeCredentialAuthDataRaw := make([]byte, 37)
+	makeCredentialSig = make([]byte, 70)
+	assertionAuthDataRaw := make([]byte, 37)
+	assertionSig = make([]byte, 70)
+	for _, b := range [][]byte{
+		makeCredentialAuthDataRaw,
+		makeCredentialSig,
+		assertionAuthDataRaw,
+		assertionSig,
+	} {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+	}
+
+	// Returned authData is CBOR-encoded, so let's do that.
+	pairs := []*[]byte{
+		&makeCredentialAuthDataRaw, &makeCredentialAuthDataCBOR,
+		&assertionAuthDataRaw, &assertionAuthDataCBOR,
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		dataRaw := pairs[i]
+		dataCBOR := pairs[i+1]
+
+		res, err := cbor.Marshal(*dataRaw)
+		if err != nil {
+			panic(err)
+		}
+		*dataCBOR = res
+	}
+}
+
+// VirtualDevice is a virtual/software FIDO2 authenticator. It implements
+// wancli.FIDODevice, plus the extra method sets required for credential
+// management, bio enrollment, reset, PIN management and CTAP2.1
+// authenticatorSelection, so it may stand in for a real authenticator
+// anywhere those wancli APIs take a device.
+//
+// A VirtualDevice also implements wancli.LoginPrompt, wancli.RegisterPrompt
+// and the credential-picking portion of a disambiguation prompt, answering
+// PromptPIN with its configured PIN and PromptTouch/PromptCredential
+// immediately, so it can double as its own prompt in simple tests.
+type VirtualDevice struct {
+	// PIN is the authenticator's configured PIN, if any. It also answers
+	// PromptPIN.
+	PIN string
+
+	// Credentials are the resident credentials held by the device.
+	Credentials []*libfido2.Credential
+
+	// U2FOnly simulates a CTAP1/U2F-only device: Info reports
+	// libfido2.ErrNotFIDO2 regardless of the configured DeviceInfo.
+	U2FOnly bool
+
+	// WantRPID, if set, makes Assertion reject calls for any other RPID
+	// instantly, mimicking a device that was only ever registered under a
+	// single RP (e.g. via the legacy U2F AppID).
+	WantRPID string
+
+	// Format controls the attestation format reported by MakeCredential.
+	Format string
+
+	// AssertionErrors is a chain of errors to return from Assertion. Errors
+	// are returned from start to end and removed, one-by-one, on each
+	// invocation of the method. If the slice is empty, Assertion runs
+	// normally.
+	AssertionErrors []error
+
+	// SelectionErrors is a chain of errors to return from Selection, with
+	// the same start-to-end, one-by-one consumption as AssertionErrors.
+	// Lets tests simulate a CTAP2.1 device that errors out of
+	// authenticatorSelection (distinct from losing the race via Cancel).
+	SelectionErrors []error
+
+	// SelectionDelay, if set, makes Selection sleep before blocking on
+	// user presence, simulating a slower device for tests that need to
+	// deterministically control which of several racing devices wins.
+	SelectionDelay time.Duration
+
+	// SelectionCalls counts invocations of Selection, letting tests assert
+	// that a single plugged-in device resolves without redundant
+	// authenticatorSelection round-trips.
+	SelectionCalls int
+
+	// ResetWindowExceeded, if true, causes Reset to fail with
+	// libfido2.ErrNotAllowed, simulating a device that was not power-cycled
+	// immediately before the call.
+	ResetWindowExceeded bool
+
+	// PINBlocked, if true, causes PIN operations to fail with
+	// libfido2.ErrPinBlocked, simulating a device whose PIN is permanently
+	// blocked until reset.
+	PINBlocked bool
+	// PINAuthBlocked, if true, causes PIN operations to fail with
+	// libfido2.ErrPinAuthBlocked, simulating a device that had too many
+	// consecutive incorrect PIN attempts this power cycle.
+	PINAuthBlocked bool
+
+	// OnInteraction, if set, is called whenever the device would otherwise
+	// block waiting for a simulated touch (see SetUP/Cancel), and its
+	// return value is used as-is. This lets tests script custom UP/UV
+	// behavior — delayed touches, programmatic rejections, and the like —
+	// beyond what SetUP/Cancel/FailUV cover.
+	OnInteraction func() error
+
+	// BioMaxSamples is the fixed number of samples required to complete a
+	// fingerprint enrollment.
+	BioMaxSamples int
+	// BioRemainingSamples/BioSamplesCaptured track an in-progress enrollment.
+	BioRemainingSamples int
+	BioSamplesCaptured  int
+	// LastEnrollmentSamplesRemaining records the remainingSamples argument of
+	// the most recent PromptEnrollmentSample call.
+	LastEnrollmentSamplesRemaining int
+
+	path              string
+	info              *libfido2.DeviceInfo
+	failUV            bool
+	bioTemplates      []*wancli.BioEnrollmentInfo
+	bioNextTemplateID byte
+	bioEnrollCanceled bool
+
+	// residentRPIDs maps a resident credential ID (as a string) to the RPID
+	// it was registered under, for credentials added via
+	// AddResidentCredentialForRP. Credentials absent from this map belong to
+	// DefaultRPID.
+	residentRPIDs map[string]string
+
+	key    *mocku2f.Key
+	pubKey []byte
+
+	// cond guards up, canceled and wasCanceled.
+	cond         *sync.Cond
+	up, canceled bool
+
+	// wasCanceled records that Cancel was called at least once. Unlike
+	// canceled, it is not cleared when a blocked call consumes the cancel.
+	wasCanceled bool
+}
+
+// NewVirtualDevice creates a VirtualDevice at path, with the given PIN (empty
+// for none), DeviceInfo (nil to simulate a CTAP1/U2F device) and resident
+// credentials.
+func NewVirtualDevice(path, pin string, info *libfido2.DeviceInfo, creds ...*libfido2.Credential) *VirtualDevice {
+	key, err := mocku2f.Create()
+	if err != nil {
+		panic(err)
+	}
+
+	pubKeyCBOR, err := wanlib.U2FKeyToCBOR(&key.PrivateKey.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+
+	dev := &VirtualDevice{
+		PIN:           pin,
+		Credentials:   creds,
+		Format:        "packed",
+		BioMaxSamples: 5,
+		path:          path,
+		info:          info,
+		key:           key,
+		pubKey:        pubKeyCBOR,
+		cond:          sync.NewCond(&sync.Mutex{}),
+	}
+	for _, cred := range creds {
+		dev.assignCredentialID(cred)
+	}
+	return dev
+}
+
+// assignCredentialID gives cred a fresh, arbitrary resident-credential ID.
+func (d *VirtualDevice) assignCredentialID(cred *libfido2.Credential) {
+	cred.ID = make([]byte, 16) // somewhat arbitrary
+	if _, err := rand.Read(cred.ID); err != nil {
+		panic(err)
+	}
+	cred.Type = libfido2.ES256
+}
+
+// AddResidentCredential adds cred to the device's resident credential store,
+// assigning it a fresh credential ID. The credential is registered under
+// DefaultRPID; use AddResidentCredentialForRP to register it
+// under a different RP.
+func (d *VirtualDevice) AddResidentCredential(cred *libfido2.Credential) {
+	d.assignCredentialID(cred)
+	d.Credentials = append(d.Credentials, cred)
+}
+
+// AddResidentCredentialForRP is like AddResidentCredential, but registers
+// cred under rpID instead of DefaultRPID. This lets tests
+// simulate an authenticator holding resident credentials for more than one
+// relying party.
+func (d *VirtualDevice) AddResidentCredentialForRP(rpID string, cred *libfido2.Credential) {
+	d.assignCredentialID(cred)
+	d.Credentials = append(d.Credentials, cred)
+	if d.residentRPIDs == nil {
+		d.residentRPIDs = make(map[string]string)
+	}
+	d.residentRPIDs[string(cred.ID)] = rpID
+}
+
+// rpidForCredential returns the RPID a resident credential was registered
+// under.
+func (d *VirtualDevice) rpidForCredential(cred *libfido2.Credential) string {
+	if rpID, ok := d.residentRPIDs[string(cred.ID)]; ok {
+		return rpID
+	}
+	return DefaultRPID
+}
+
+// SetUP simulates a touch/user-presence event on the device.
+func (d *VirtualDevice) SetUP() {
+	d.cond.L.Lock()
+	d.up = true
+	d.cond.L.Unlock()
+	d.cond.Broadcast()
+}
+
+// Canceled reports whether the device has been canceled, as happens when it
+// loses a multi-device race (see wancli.FIDO2SelectDevice).
+func (d *VirtualDevice) Canceled() bool {
+	d.cond.L.Lock()
+	defer d.cond.L.Unlock()
+	return d.wasCanceled
+}
+
+// FailUV makes the device answer UV requests with "unsupported option",
+// regardless of other conditions, as seen in some real authenticators.
+func (d *VirtualDevice) FailUV(fail bool) {
+	d.failUV = fail
+}
+
+// CredentialID returns the device's non-resident ("base") credential ID.
+func (d *VirtualDevice) CredentialID() []byte {
+	return d.key.KeyHandle
+}
+
+// Path returns the device's path, as presented via FIDODeviceLocations.
+func (d *VirtualDevice) Path() string {
+	return d.path
+}
+
+// Cert returns the device's attestation certificate.
+func (d *VirtualDevice) Cert() []byte {
+	return d.key.Cert
+}
+
+// PromptPIN implements wancli.LoginPrompt/wancli.RegisterPrompt, answering
+// with the device's configured PIN.
+func (d *VirtualDevice) PromptPIN() (string, error) {
+	return d.PIN, nil
+}
+
+// PromptTouch implements wancli.LoginPrompt/wancli.RegisterPrompt, answering
+// by touching the device itself.
+func (d *VirtualDevice) PromptTouch() error {
+	d.SetUP()
+	return nil
+}
+
+// PromptCredential implements the credential-disambiguation portion of
+// wancli.LoginPrompt, always picking the first candidate.
+func (d *VirtualDevice) PromptCredential(creds []*wancli.CredentialInfo) (*wancli.CredentialInfo, error) {
+	if len(creds) == 0 {
+		return nil, errors.New("no credentials to choose from")
+	}
+	return creds[0], nil
+}
+
+// PromptEnrollmentSample implements wancli.BioEnrollPrompt, recording the
+// remaining sample count for tests to assert on.
+func (d *VirtualDevice) PromptEnrollmentSample(remainingSamples int) {
+	d.LastEnrollmentSamplesRemaining = remainingSamples
+}
+
+// Info implements wancli.FIDODevice.
+func (d *VirtualDevice) Info() (*libfido2.DeviceInfo, error) {
+	if d.U2FOnly {
+		return nil, libfido2.ErrNotFIDO2
+	}
+	return d.info, nil
+}
+
+// Cancel implements wancli.FIDODevice.
+func (d *VirtualDevice) Cancel() error {
+	d.cond.L.Lock()
+	d.canceled = true
+	d.wasCanceled = true
+	d.cond.L.Unlock()
+	d.cond.Broadcast()
+	return nil
+}
+
+// MakeCredential implements wancli.FIDODevice.
+func (d *VirtualDevice) MakeCredential(
+	clientDataHash []byte,
+	rp libfido2.RelyingParty,
+	user libfido2.User,
+	typ libfido2.CredentialType,
+	pin string,
+	opts *libfido2.MakeCredentialOpts,
+) (*libfido2.Attestation, error) {
+	switch {
+	case len(clientDataHash) == 0:
+		return nil, errors.New("clientDataHash required")
+	case rp.ID == "":
+		return nil, errors.New("rp.ID required")
+	case typ != libfido2.ES256:
+		return nil, errors.New("bad credential type")
+	case opts.UV == libfido2.False: // can only be empty or true
+		return nil, libfido2.ErrUnsupportedOption
+	case opts.UV == libfido2.True && !d.hasUV():
+		return nil, libfido2.ErrUnsupportedOption // PIN authenticators don't like UV
+	case opts.RK == libfido2.True && !d.hasRK():
+		// TODO(codingllama): Confirm scenario with a real authenticator.
+		return nil, libfido2.ErrUnsupportedOption
+	case hasHMACSecretExt(opts.Extensions) && !d.hasExtension(libfido2.HMACSecretExtension):
+		return nil, libfido2.ErrUnsupportedOption
+	}
+
+	// Validate PIN regardless of opts.
+	// This is in line with how current YubiKeys behave.
+	if err := d.validatePIN(pin); err != nil {
+		return nil, err
+	}
+
+	if err := d.maybeLockUntilInteraction(true /* up */); err != nil {
+		return nil, err
+	}
+
+	cert, sig := d.Cert(), makeCredentialSig
+	if d.Format == "none" {
+		// Do not return attestation data in case of "none".
+		// This is a hypothetical scenario, as I haven't seen device that does this.
+		cert, sig = nil, nil
+	}
+
+	// Did we create a resident credential? Create a new ID for it and record it.
+	cID := d.key.KeyHandle
+	if opts.RK == libfido2.True {
+		cID = make([]byte, 16) // somewhat arbitrary
+		if _, err := rand.Read(cID); err != nil {
+			return nil, err
+		}
+		d.Credentials = append(d.Credentials, &libfido2.Credential{
+			ID:   cID,
+			Type: libfido2.ES256,
+			User: user,
+		})
+	}
+
+	return &libfido2.Attestation{
+		ClientDataHash: clientDataHash,
+		AuthData:       makeCredentialAuthDataCBOR,
+		CredentialID:   cID,
+		CredentialType: libfido2.ES256,
+		PubKey:         d.pubKey,
+		Cert:           cert,
+		Sig:            sig,
+		Format:         d.Format,
+	}, nil
+}
+
+// Assertion implements wancli.FIDODevice.
+func (d *VirtualDevice) Assertion(
+	rpID string,
+	clientDataHash []byte,
+	credentialIDs [][]byte,
+	pin string,
+	opts *libfido2.AssertionOpts,
+) ([]*libfido2.Assertion, error) {
+	// Give preference to simulated errors.
+	if len(d.AssertionErrors) > 0 {
+		err := d.AssertionErrors[0]
+		d.AssertionErrors = d.AssertionErrors[1:]
+		return nil, err
+	}
+
+	switch {
+	case rpID == "":
+		return nil, errors.New("rp.ID required")
+	case d.WantRPID != "" && d.WantRPID != rpID:
+		return nil, libfido2.ErrNoCredentials
+	case len(clientDataHash) == 0:
+		return nil, errors.New("clientDataHash required")
+	}
+
+	// Real CTAP1/U2F devices can check whether a key handle is theirs without
+	// a touch, so reject a non-matching credential immediately, rather than
+	// blocking for presence like a CTAP2 device would.
+	if d.U2FOnly && len(credentialIDs) > 0 {
+		matched := false
+		for _, id := range credentialIDs {
+			if string(id) == string(d.key.KeyHandle) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, libfido2.ErrNoCredentials
+		}
+	}
+
+	// Validate UV.
+	switch {
+	case opts.UV == "": // OK, actually works as false.
+	case opts.UV == libfido2.True && d.failUV:
+		// Emulate UV failures, as seen in some devices regardless of other
+		// settings.
+		return nil, libfido2.ErrUnsupportedOption
+	case opts.UV == libfido2.True && d.isBio(): // OK.
+	case opts.UV == libfido2.True && d.hasClientPin() && pin != "": // OK, doubles as UV.
+	default: // Anything else is invalid, including libfido2.False.
+		return nil, libfido2.ErrUnsupportedOption
+	}
+
+	// Validate PIN only if present and UP is required.
+	// This is in line with how current YubiKeys behave.
+	// TODO(codingllama): This should probably take UV into consideration.
+	privilegedAccess := d.isBio()
+	if pin != "" && opts.UP == libfido2.True {
+		if err := d.validatePIN(pin); err != nil {
+			return nil, err
+		}
+		privilegedAccess = true
+	}
+
+	// A silent (UP=false) preflight never touches user presence: it only
+	// tells the caller whether a matching credential is present, so skip the
+	// lock entirely instead of relying on it to no-op.
+	if opts.UP != libfido2.False {
+		if err := d.maybeLockUntilInteraction(opts.UP == libfido2.True); err != nil {
+			return nil, err
+		}
+	}
+
+	// Index credentialIDs for easier use.
+	credIDs := make(map[string]struct{})
+	for _, cred := range credentialIDs {
+		credIDs[string(cred)] = struct{}{}
+	}
+
+	// Assemble one assertion for each allowed credential we hold.
+	var assertions []*libfido2.Assertion
+
+	// "base" credential. Only add an assertion if explicitly requested.
+	if _, ok := credIDs[string(d.key.KeyHandle)]; ok {
+		assertions = append(assertions, &libfido2.Assertion{
+			AuthDataCBOR: assertionAuthDataCBOR,
+			Sig:          assertionSig,
+			CredentialID: d.key.KeyHandle,
+			User:         libfido2.User{
+				// We don't hold data about the user for the "base" credential / MFA
+				// scenario.
+				// A typical authenticator might choose to save some data within the
+				// key handle itself.
+			},
+		})
+	}
+
+	// Resident credentials.
+	if privilegedAccess {
+		for _, resident := range d.Credentials {
+			allowed := len(credIDs) == 0
+			if !allowed {
+				_, allowed = credIDs[string(resident.ID)]
+			}
+			if !allowed {
+				continue
+			}
+			var hmacSecret []byte
+			if hasHMACSecretExt(opts.Extensions) && d.hasExtension(libfido2.HMACSecretExtension) && len(opts.HMACSalt) > 0 {
+				hmacSecret = deterministicHMACSecret(resident.ID, opts.HMACSalt)
+			}
+
+			assertions = append(assertions, &libfido2.Assertion{
+				AuthDataCBOR: assertionAuthDataCBOR,
+				Sig:          assertionSig,
+				HMACSecret:   hmacSecret,
+				CredentialID: resident.ID,
+				User: libfido2.User{
+					ID:          resident.User.ID,
+					Name:        resident.User.Name,
+					DisplayName: resident.User.DisplayName,
+					Icon:        resident.User.Icon,
+				},
+			})
+		}
+	}
+
+	switch len(assertions) {
+	case 0:
+		return nil, libfido2.ErrNoCredentials
+	case 1:
+		// Remove user name / display name / icon.
+		// See the authenticatorGetAssertion response structure, user member (0x04):
+		// https://fidoalliance.org/specs/fido-v2.1-ps-20210615/fido-client-to-authenticator-protocol-v2.1-ps-20210615.html#authenticatorgetassertion-response-structure
+		assertions[0].User.Name = ""
+		assertions[0].User.DisplayName = ""
+		assertions[0].User.Icon = ""
+		return assertions, nil
+	default:
+		return assertions, nil
+	}
+}
+
+func (d *VirtualDevice) validatePIN(pin string) error {
+	switch {
+	case d.PINBlocked:
+		return libfido2.ErrPinBlocked
+	case d.PINAuthBlocked:
+		return libfido2.ErrPinAuthBlocked
+	case d.isBio() && pin == "": // OK, biometric check supersedes PIN.
+	case d.PIN != "" && pin == "":
+		return libfido2.ErrPinRequired
+	case d.PIN != "" && d.PIN != pin:
+		return libfido2.ErrPinInvalid
+	}
+	return nil
+}
+
+func (d *VirtualDevice) hasClientPin() bool {
+	return d.hasBoolOpt("clientPin")
+}
+
+// HasClientPIN reports whether the device currently advertises the
+// "clientPin" option, i.e. whether a PIN has been configured. Exported so
+// callers outside the package can assert on PIN state after
+// FIDO2Reset/FIDO2SetPIN/FIDO2ChangePIN.
+func (d *VirtualDevice) HasClientPIN() bool {
+	return d.hasClientPin()
+}
+
+func (d *VirtualDevice) hasRK() bool {
+	return d.hasBoolOpt("rk")
+}
+
+func (d *VirtualDevice) hasUV() bool {
+	return d.hasBoolOpt("uv")
+}
+
+func (d *VirtualDevice) isBio() bool {
+	return d.hasBoolOpt("bioEnroll")
+}
+
+// hasExtension reports whether the device advertises support for the named
+// CTAP2 extension in its getInfo response.
+func (d *VirtualDevice) hasExtension(name string) bool {
+	if d.info == nil {
+		return false
+	}
+	for _, ext := range d.info.Extensions {
+		if ext == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHMACSecretExt reports whether opts requested the hmac-secret
+// extension.
+func hasHMACSecretExt(exts libfido2.Extensions) bool {
+	for _, ext := range exts {
+		if ext == libfido2.HMACSecretExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// deterministicHMACSecret derives a fixed, reproducible hmac-secret output
+// for credID/salt, standing in for the authenticator-side derivation a real
+// CTAP2 device performs. Deterministic so tests can assert on it directly.
+func deterministicHMACSecret(credID, salt []byte) []byte {
+	mac := hmac.New(sha256.New, credID)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+func (d *VirtualDevice) hasBoolOpt(name string) bool {
+	if d.info == nil {
+		return false
+	}
+
+	for _, opt := range d.info.Options {
+		if opt.Name == name {
+			return opt.Value == libfido2.True
+		}
+	}
+	return false
+}
+
+// Selection mimics the CTAP2.1 authenticatorSelection command: it blocks
+// until the device is touched or canceled.
+func (d *VirtualDevice) Selection() error {
+	d.SelectionCalls++
+
+	if d.SelectionDelay > 0 {
+		time.Sleep(d.SelectionDelay)
+	}
+
+	// Give preference to simulated errors.
+	if len(d.SelectionErrors) > 0 {
+		err := d.SelectionErrors[0]
+		d.SelectionErrors = d.SelectionErrors[1:]
+		return err
+	}
+
+	return d.maybeLockUntilInteraction(true)
+}
+
+// Reset mimics authenticatorReset: it wipes all resident credentials and the
+// PIN.
+func (d *VirtualDevice) Reset() error {
+	if d.ResetWindowExceeded {
+		return libfido2.ErrNotAllowed
+	}
+	d.Credentials = nil
+	d.PIN = ""
+	d.setBoolOpt("clientPin", false)
+	return nil
+}
+
+// SetPIN mimics authenticatorClientPIN's "setPIN"/"changePIN" subcommands,
+// depending on whether oldPIN is supplied.
+func (d *VirtualDevice) SetPIN(pin, oldPIN string) error {
+	switch {
+	case oldPIN == "" && d.hasClientPin():
+		return errors.New("PIN already set, use changePIN")
+	case oldPIN != "":
+		if err := d.validatePIN(oldPIN); err != nil {
+			return err
+		}
+	}
+	d.PIN = pin
+	d.setBoolOpt("clientPin", true)
+	return nil
+}
+
+// setBoolOpt updates (or adds) a boolean device option, mimicking how an
+// authenticator's advertised capabilities change after state transitions
+// like setting a PIN or resetting.
+func (d *VirtualDevice) setBoolOpt(name string, value bool) {
+	if d.info == nil {
+		return
+	}
+	strVal := "false"
+	if value {
+		strVal = "true"
+	}
+	for i, opt := range d.info.Options {
+		if opt.Name == name {
+			d.info.Options[i].Value = strVal
+			return
+		}
+	}
+	d.info.Options = append(d.info.Options, libfido2.Option{Name: name, Value: strVal})
+}
+
+func (d *VirtualDevice) maybeLockUntilInteraction(up bool) error {
+	if !up {
+		return nil // without UserPresence it doesn't lock.
+	}
+
+	// OnInteraction, if set, takes over entirely: it decides whether/how the
+	// simulated touch happens instead of waiting on SetUP/Cancel, letting
+	// tests script custom UP/UV behavior (delayed touches, programmatic
+	// rejections, etc).
+	if d.OnInteraction != nil {
+		return d.OnInteraction()
+	}
+
+	// Lock until we get a touch or a cancel.
+	d.cond.L.Lock()
+	for !d.up && !d.canceled {
+		d.cond.Wait()
+	}
+	defer d.cond.L.Unlock()
+
+	// Record/reset state.
+	isCancel := d.canceled
+	d.up = false
+	d.canceled = false
+
+	if isCancel {
+		return libfido2.ErrKeepaliveCancel
+	}
+	return nil
+}
+
+// CredentialsInfo mimics libfido2's authenticatorCredentialManagement
+// "getCredsMetadata" subcommand.
+func (d *VirtualDevice) CredentialsInfo(pin string) (*libfido2.CredentialsInfo, error) {
+	if err := d.validatePIN(pin); err != nil {
+		return nil, err
+	}
+	return &libfido2.CredentialsInfo{
+		RKExisting:  uint64(len(d.Credentials)),
+		RKRemaining: 100 - uint64(len(d.Credentials)),
+	}, nil
+}
+
+// EnumerateRPs mimics the "enumerateRPsBegin"/"enumerateRPsGetNextRP"
+// subcommands, returning one entry per distinct RP with resident
+// credentials (see AddResidentCredentialForRP).
+func (d *VirtualDevice) EnumerateRPs(pin string) ([]*libfido2.RelyingParty, error) {
+	if err := d.validatePIN(pin); err != nil {
+		return nil, err
+	}
+	var rps []*libfido2.RelyingParty
+	seen := make(map[string]bool)
+	for _, cred := range d.Credentials {
+		rpID := d.rpidForCredential(cred)
+		if seen[rpID] {
+			continue
+		}
+		seen[rpID] = true
+		rps = append(rps, &libfido2.RelyingParty{ID: rpID})
+	}
+	return rps, nil
+}
+
+// EnumerateCredentials mimics "enumerateCredentialsBegin"/
+// "enumerateCredentialsGetNextCredential".
+func (d *VirtualDevice) EnumerateCredentials(pin string, rp *libfido2.RelyingParty) ([]*libfido2.Credential, error) {
+	if err := d.validatePIN(pin); err != nil {
+		return nil, err
+	}
+	if rp == nil {
+		return nil, nil
+	}
+	var creds []*libfido2.Credential
+	for _, cred := range d.Credentials {
+		if d.rpidForCredential(cred) == rp.ID {
+			creds = append(creds, cred)
+		}
+	}
+	return creds, nil
+}
+
+// DeleteCredential mimics the "deleteCredential" subcommand.
+func (d *VirtualDevice) DeleteCredential(credID []byte, pin string) error {
+	if err := d.validatePIN(pin); err != nil {
+		return err
+	}
+	for i, cred := range d.Credentials {
+		if string(cred.ID) == string(credID) {
+			d.Credentials = append(d.Credentials[:i], d.Credentials[i+1:]...)
+			delete(d.residentRPIDs, string(credID))
+			return nil
+		}
+	}
+	return libfido2.ErrNoCredentials
+}
+
+// UpdateUserInfo mimics the "updateUserInformation" subcommand, replacing
+// the name and display name of a resident credential in place. The
+// credential's user ID and public key are unchanged.
+func (d *VirtualDevice) UpdateUserInfo(credID []byte, user libfido2.User, pin string) error {
+	if err := d.validatePIN(pin); err != nil {
+		return err
+	}
+	for i, cred := range d.Credentials {
+		if string(cred.ID) == string(credID) {
+			d.Credentials[i].User.Name = user.Name
+			d.Credentials[i].User.DisplayName = user.DisplayName
+			return nil
+		}
+	}
+	return libfido2.ErrNoCredentials
+}
+
+// BioInfo mimics authenticatorBioEnrollment's "getFingerprintSensorInfo"
+// subcommand.
+func (d *VirtualDevice) BioInfo() (*libfido2.BioInfo, error) {
+	if !d.isBio() {
+		return nil, libfido2.ErrUnsupportedOption
+	}
+	return &libfido2.BioInfo{
+		Type:       1,
+		MaxSamples: d.BioMaxSamples,
+	}, nil
+}
+
+// BioEnrollEnumerate mimics "enumerateEnrollments".
+func (d *VirtualDevice) BioEnrollEnumerate(pin string) ([]*wancli.BioEnrollmentInfo, error) {
+	if !d.isBio() {
+		return nil, libfido2.ErrUnsupportedOption
+	}
+	if err := d.validatePIN(pin); err != nil {
+		return nil, err
+	}
+	templates := make([]*wancli.BioEnrollmentInfo, len(d.bioTemplates))
+	copy(templates, d.bioTemplates)
+	return templates, nil
+}
+
+// BioEnroll mimics "enrollBegin", capturing the first sample of a new
+// enrollment and returning the resulting templateID.
+func (d *VirtualDevice) BioEnroll(pin string) ([]byte, error) {
+	if !d.isBio() {
+		return nil, libfido2.ErrUnsupportedOption
+	}
+	if err := d.validatePIN(pin); err != nil {
+		return nil, err
+	}
+
+	d.bioNextTemplateID++
+	templateID := []byte{d.bioNextTemplateID}
+	d.bioTemplates = append(d.bioTemplates, &wancli.BioEnrollmentInfo{TemplateID: templateID})
+
+	d.BioRemainingSamples = d.BioMaxSamples - 1
+	d.BioSamplesCaptured = 1
+	return templateID, nil
+}
+
+// BioEnrollContinue mimics "enrollCaptureNextSample", capturing one sample
+// per call until the template is complete.
+func (d *VirtualDevice) BioEnrollContinue(pin string, templateID []byte) (int, error) {
+	if !d.isBio() {
+		return 0, libfido2.ErrUnsupportedOption
+	}
+	if d.bioEnrollCanceled {
+		d.bioEnrollCanceled = false
+		return 0, libfido2.ErrKeepaliveCancel
+	}
+	if d.BioRemainingSamples <= 0 {
+		return 0, nil // already complete, nothing to do.
+	}
+	d.BioRemainingSamples--
+	d.BioSamplesCaptured++
+	return d.BioRemainingSamples, nil
+}
+
+// BioEnrollCancel mimics "cancelCurrentEnrollment". Unlike reaching
+// BioRemainingSamples == 0 through normal capture, a cancellation is
+// distinguished so the next BioEnrollContinue call reports
+// libfido2.ErrKeepaliveCancel rather than looking like a completed
+// enrollment.
+func (d *VirtualDevice) BioEnrollCancel() error {
+	if d.BioRemainingSamples > 0 {
+		d.bioEnrollCanceled = true
+	}
+	d.BioRemainingSamples = 0
+	return nil
+}
+
+// BioEnrollRemove mimics "removeEnrollment".
+func (d *VirtualDevice) BioEnrollRemove(pin string, templateID []byte) error {
+	if err := d.validatePIN(pin); err != nil {
+		return err
+	}
+	for i, tmpl := range d.bioTemplates {
+		if string(tmpl.TemplateID) == string(templateID) {
+			d.bioTemplates = append(d.bioTemplates[:i], d.bioTemplates[i+1:]...)
+			return nil
+		}
+	}
+	return libfido2.ErrNoCredentials
+}
+
+// BioEnrollName mimics "setFriendlyName".
+func (d *VirtualDevice) BioEnrollName(pin string, templateID []byte, name string) error {
+	if err := d.validatePIN(pin); err != nil {
+		return err
+	}
+	for _, tmpl := range d.bioTemplates {
+		if string(tmpl.TemplateID) == string(templateID) {
+			tmpl.FriendlyName = name
+			return nil
+		}
+	}
+	return libfido2.ErrNoCredentials
+}
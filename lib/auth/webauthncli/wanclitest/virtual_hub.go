@@ -0,0 +1,126 @@
+//go:build libfido2
+// +build libfido2
+
+// Copyright 2022 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wanclitest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/keys-pub/go-libfido2"
+
+	wancli "github.com/gravitational/teleport/lib/auth/webauthncli"
+)
+
+// VirtualHub stands in for the USB bus, presenting a fixed set of
+// VirtualDevices to wancli via wancli.FIDODeviceLocations/wancli.FIDONewDevice.
+// Install it with SetCallbacks, and restore the originals (for example via
+// t.Cleanup) once the test is done.
+type VirtualHub struct {
+	useNonMeteredLocs bool
+
+	locs    []*libfido2.DeviceLocation
+	devices map[string]*VirtualDevice
+}
+
+// NewVirtualHub creates a VirtualHub presenting devs.
+func NewVirtualHub(devs ...*VirtualDevice) *VirtualHub {
+	h := &VirtualHub{
+		devices: make(map[string]*VirtualDevice),
+	}
+	for _, dev := range devs {
+		if _, ok := h.devices[dev.path]; ok {
+			panic(fmt.Sprintf("Duplicate device path registered: %q", dev.path))
+		}
+		h.locs = append(h.locs, &libfido2.DeviceLocation{
+			Path: dev.path,
+		})
+		h.devices[dev.path] = dev
+	}
+	return h
+}
+
+// WithNonMeteredLocations makes the hub return all known devices immediately,
+// rather than metering them out over a few polls. Useful to test flows that
+// optimize for already-plugged devices.
+func (h *VirtualHub) WithNonMeteredLocations() *VirtualHub {
+	h.useNonMeteredLocs = true
+	return h
+}
+
+// SetCallbacks installs the hub into wancli.FIDODeviceLocations and
+// wancli.FIDONewDevice, so subsequent wancli calls see its VirtualDevices.
+// Callers are responsible for restoring the originals afterwards (see
+// Replace for a self-cleaning alternative).
+func (h *VirtualHub) SetCallbacks() {
+	if h.useNonMeteredLocs {
+		wancli.FIDODeviceLocations = h.DeviceLocations
+	} else {
+		wancli.FIDODeviceLocations = h.newMeteredDeviceLocations()
+	}
+	wancli.FIDONewDevice = h.NewDevice
+}
+
+// Replace installs the hub into wancli.FIDODeviceLocations and
+// wancli.FIDONewDevice for the duration of t, restoring the original values
+// via t.Cleanup. It also resets wancli.FIDO2PollInterval to 1ms for t, since
+// tests driving a VirtualHub have no reason to wait on the real polling
+// interval.
+func (h *VirtualHub) Replace(t testing.TB) {
+	t.Helper()
+
+	origLocations := wancli.FIDODeviceLocations
+	origNewDevice := wancli.FIDONewDevice
+	origPollInterval := wancli.FIDO2PollInterval
+	t.Cleanup(func() {
+		wancli.FIDODeviceLocations = origLocations
+		wancli.FIDONewDevice = origNewDevice
+		wancli.FIDO2PollInterval = origPollInterval
+	})
+
+	wancli.FIDO2PollInterval = 1 * time.Millisecond
+	h.SetCallbacks()
+}
+
+func (h *VirtualHub) newMeteredDeviceLocations() func() ([]*libfido2.DeviceLocation, error) {
+	i := 0
+	return func() ([]*libfido2.DeviceLocation, error) {
+		// Delay showing devices for a while to exercise polling.
+		i++
+		const minLoops = 2
+		if i < minLoops {
+			return nil, nil
+		}
+		return h.locs, nil
+	}
+}
+
+// DeviceLocations implements the wancli.FIDODeviceLocations signature.
+func (h *VirtualHub) DeviceLocations() ([]*libfido2.DeviceLocation, error) {
+	return h.locs, nil
+}
+
+// NewDevice implements the wancli.FIDONewDevice signature.
+func (h *VirtualHub) NewDevice(path string) (wancli.FIDODevice, error) {
+	if dev, ok := h.devices[path]; ok {
+		return dev, nil
+	}
+	// go-libfido2 doesn't actually error here, but we do for simplicity.
+	return nil, errors.New("not found")
+}